@@ -6,6 +6,8 @@ import (
 	"os"
 	"time"
 
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
 	"github.com/garethjevans/backport/pkg/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -18,7 +20,38 @@ func main() {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
-	controller := webhook.Controller{}
+	app, err := service.NewGitHubAppFromEnv()
+	if err != nil {
+		logrus.Fatalf("unable to configure the github app %v", err)
+	}
+
+	opts, err := queue.OptionsFromEnv()
+	if err != nil {
+		logrus.Fatalf("unable to configure the queue %v", err)
+	}
+
+	options, err := service.BackportOptionsFromEnv()
+	if err != nil {
+		logrus.Fatalf("unable to configure the backports %v", err)
+	}
+
+	authorization, err := service.AuthorizationFromEnv()
+	if err != nil {
+		logrus.Fatalf("unable to configure who can request backports %v", err)
+	}
+
+	controller := &webhook.Controller{GitHubApp: app, Options: options, Authorization: authorization}
+	controller.Queue = queue.New(controller.RunJob, opts)
+	defer controller.Queue.Stop()
+
+	// the service reports that it is not ready until the unfinished jobs are resumed,
+	// the backports requested in the meantime are queued once they have been
+	go func() {
+		err := controller.Queue.Start()
+		if err != nil {
+			logrus.Fatalf("unable to resume the queued backports %v", err)
+		}
+	}()
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte("backport is alive"))
@@ -29,12 +62,15 @@ func main() {
 
 	r.Get("/health", controller.Health)
 	r.Get("/ready", controller.Ready)
+	r.Get("/jobs", webhook.Authenticated(controller.Jobs))
+	r.Get("/jobs/{id}", webhook.Authenticated(controller.Job))
+	r.Get("/backports", webhook.Authenticated(controller.Backports))
 
 	r.Post("/", controller.DefaultHandler)
 
 	srv := &http.Server{
 		ReadTimeout:       1 * time.Second,
-		WriteTimeout:      1 * time.Second,
+		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       30 * time.Second,
 		ReadHeaderTimeout: 2 * time.Second,
 		Handler:           r,
@@ -43,7 +79,7 @@ func main() {
 
 	logrus.Infof("binding to %s", port())
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		panic(err)
 	}
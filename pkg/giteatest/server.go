@@ -0,0 +1,471 @@
+// Package giteatest provides a disposable, in-process stand-in for a Gitea (or
+// Forgejo) server so that backports can be exercised without any network access.
+//
+// The server implements the subset of the Gitea API used by backport and serves
+// the git smart HTTP protocol from bare repositories on disk via git http-backend.
+package giteatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+const version = "1.20.0"
+
+// PullRequest describes a pull request held by the server.
+type PullRequest struct {
+	Number int
+	Title  string
+	Body   string
+	Head   string
+	Base   string
+	Merged bool
+	// Closed is set when the PR was closed without being merged.
+	Closed  bool
+	Labels  []string
+	Commits []string
+	// MergeSha is the commit the PR was merged as.
+	MergeSha string
+	// Assignees are the logins of the users the PR is assigned to.
+	Assignees []string
+	// Milestone is the id of the PR's milestone, or 0 if it has none.
+	Milestone int64
+}
+
+type repository struct {
+	pulls    []*PullRequest
+	comments map[int][]*gitea.Comment
+	labels   []string
+	// lastComment is the id of the last comment made on the repository.
+	lastComment int64
+}
+
+// Server is a fake Gitea server backed by bare git repositories in a directory.
+type Server struct {
+	*httptest.Server
+
+	root  string
+	mu    sync.Mutex
+	repos map[string]*repository
+	// username and password, when set, are required to clone and push.
+	username string
+	password string
+}
+
+// NewServer starts a server that stores its repositories under root.
+func NewServer(root string) (*Server, error) {
+	backend, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{root: root, repos: map[string]*repository{}}
+
+	git := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(backend)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/", s.api)
+	mux.Handle("/", s.authenticated(git))
+
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// RequireCredentials makes the repositories private, so that they can only be cloned
+// and pushed to with the username and password.
+func (s *Server) RequireCredentials(username string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password = username, password
+}
+
+func (s *Server) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		username, password := s.username, s.password
+		s.mu.Unlock()
+
+		if username != "" {
+			u, p, ok := r.BasicAuth()
+			if !ok || u != username || p != password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="giteatest"`)
+				http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CreateRepo initialises an empty bare repository and returns its path on disk.
+func (s *Server) CreateRepo(owner string, name string) (string, error) {
+	path := filepath.Join(s.root, owner, name)
+	err := os.MkdirAll(path, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	for _, args := range [][]string{
+		{"init", "--bare", "--initial-branch=main"},
+		{"config", "http.receivepack", "true"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", path}, args...)...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %s: %w", strings.Join(args, " "), out, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos[owner+"/"+name] = &repository{comments: map[int][]*gitea.Comment{}}
+	return path, nil
+}
+
+// AddPullRequest registers a pull request against the repository.
+func (s *Server) AddPullRequest(owner string, name string, pr PullRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.repos[owner+"/"+name]
+	r.pulls = append(r.pulls, &pr)
+}
+
+// PullRequests returns the pull requests held for the repository.
+func (s *Server) PullRequests(owner string, name string) []PullRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var prs []PullRequest
+	for _, pr := range s.repos[owner+"/"+name].pulls {
+		prs = append(prs, *pr)
+	}
+	return prs
+}
+
+// AddComment adds a comment made by the user with the login to a pull request.
+func (s *Server) AddComment(owner string, name string, number int, login string, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.repos[owner+"/"+name]
+	r.lastComment++
+	r.comments[number] = append(r.comments[number], &gitea.Comment{ID: r.lastComment, Body: body, Poster: &gitea.User{ID: 2, UserName: login}})
+}
+
+// Comments returns the comments made on a pull request.
+func (s *Server) Comments(owner string, name string, number int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var comments []string
+	for _, comment := range s.repos[owner+"/"+name].comments[number] {
+		comments = append(comments, comment.Body)
+	}
+	return comments
+}
+
+func (s *Server) api(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+	if len(parts) == 1 && parts[0] == "version" {
+		writeJSON(w, http.StatusOK, map[string]string{"version": version})
+		return
+	}
+	if len(parts) == 1 && parts[0] == "user" {
+		// every request is made as the one user
+		writeJSON(w, http.StatusOK, user())
+		return
+	}
+
+	if len(parts) < 4 || parts[0] != "repos" {
+		http.NotFound(w, r)
+		return
+	}
+
+	owner, name := parts[1], parts[2]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repo, ok := s.repos[owner+"/"+name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	route := r.Method + " " + strings.Join(parts[3:], "/")
+	number := 0
+	if len(parts) == 6 && parts[4] == "comments" {
+		// comments are addressed by their id rather than the issue they are on
+		number, _ = strconv.Atoi(parts[5])
+		route = r.Method + " " + parts[3] + "/comments/{id}"
+	} else if len(parts) > 4 {
+		number, _ = strconv.Atoi(parts[4])
+		route = r.Method + " " + parts[3] + "/{number}/" + strings.Join(parts[5:], "/")
+		route = strings.TrimSuffix(route, "/")
+	}
+
+	switch route {
+	case "GET branches":
+		s.listBranches(w, owner, name)
+	case "GET labels":
+		var labels []*gitea.Label
+		for i, label := range repo.labels {
+			labels = append(labels, &gitea.Label{ID: int64(i + 1), Name: label})
+		}
+		writeJSON(w, http.StatusOK, labels)
+	case "POST labels":
+		var in gitea.CreateLabelOption
+		if !readJSON(w, r, &in) {
+			return
+		}
+		repo.labels = append(repo.labels, in.Name)
+		writeJSON(w, http.StatusCreated, gitea.Label{ID: int64(len(repo.labels)), Name: in.Name})
+	case "GET pulls":
+		var pulls []*gitea.PullRequest
+		for _, pr := range repo.pulls {
+			pulls = append(pulls, s.convert(owner, name, pr))
+		}
+		writeJSON(w, http.StatusOK, pulls)
+	case "POST pulls":
+		var in gitea.CreatePullRequestOption
+		if !readJSON(w, r, &in) {
+			return
+		}
+		pr := &PullRequest{Number: len(repo.pulls) + 1, Title: in.Title, Body: in.Body, Head: in.Head, Base: in.Base}
+		repo.pulls = append(repo.pulls, pr)
+		writeJSON(w, http.StatusCreated, s.convert(owner, name, pr))
+	case "GET pulls/{number}":
+		pr := repo.find(number)
+		if pr == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.convert(owner, name, pr))
+	case "PATCH pulls/{number}":
+		var in gitea.EditPullRequestOption
+		if !readJSON(w, r, &in) {
+			return
+		}
+		pr := repo.find(number)
+		if pr == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if in.State != nil {
+			pr.Closed = *in.State == gitea.StateClosed
+		}
+		writeJSON(w, http.StatusCreated, s.convert(owner, name, pr))
+	case "GET pulls/{number}/commits":
+		pr := repo.find(number)
+		if pr == nil {
+			http.NotFound(w, r)
+			return
+		}
+		var commits []*gitea.Commit
+		for _, sha := range pr.Commits {
+			commits = append(commits, &gitea.Commit{CommitMeta: &gitea.CommitMeta{SHA: sha}})
+		}
+		writeJSON(w, http.StatusOK, commits)
+	case "GET issues/{number}":
+		pr := repo.find(number)
+		if pr == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, issue(s.convert(owner, name, pr)))
+	case "PATCH issues/{number}":
+		var in gitea.EditIssueOption
+		if !readJSON(w, r, &in) {
+			return
+		}
+		pr := repo.find(number)
+		if pr == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if in.Assignees != nil {
+			pr.Assignees = in.Assignees
+		}
+		if in.Milestone != nil {
+			pr.Milestone = *in.Milestone
+		}
+		writeJSON(w, http.StatusCreated, issue(s.convert(owner, name, pr)))
+	case "POST issues/{number}/comments":
+		var in gitea.CreateIssueCommentOption
+		if !readJSON(w, r, &in) {
+			return
+		}
+		repo.lastComment++
+		comment := &gitea.Comment{ID: repo.lastComment, Body: in.Body, Poster: user()}
+		repo.comments[number] = append(repo.comments[number], comment)
+		writeJSON(w, http.StatusCreated, comment)
+	case "GET issues/{number}/comments":
+		comments := []*gitea.Comment{}
+		comments = append(comments, repo.comments[number]...)
+		writeJSON(w, http.StatusOK, comments)
+	case "PATCH issues/comments/{id}":
+		var in gitea.EditIssueCommentOption
+		if !readJSON(w, r, &in) {
+			return
+		}
+		comment := repo.findComment(int64(number))
+		if comment == nil {
+			http.NotFound(w, r)
+			return
+		}
+		comment.Body = in.Body
+		writeJSON(w, http.StatusOK, comment)
+	case "POST issues/{number}/labels":
+		var in gitea.IssueLabelsOption
+		if !readJSON(w, r, &in) {
+			return
+		}
+		pr := repo.find(number)
+		if pr == nil {
+			http.NotFound(w, r)
+			return
+		}
+		for _, id := range in.Labels {
+			pr.Labels = append(pr.Labels, repo.labels[id-1])
+		}
+		writeJSON(w, http.StatusOK, []*gitea.Label{})
+	default:
+		http.Error(w, fmt.Sprintf("%s is not implemented", route), http.StatusNotImplemented)
+	}
+}
+
+func (s *Server) listBranches(w http.ResponseWriter, owner string, name string) {
+	out, err := exec.Command("git", "-C", filepath.Join(s.root, owner, name), "for-each-ref", "--format=%(refname:short) %(objectname)", "refs/heads").Output()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var branches []*gitea.Branch
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			branches = append(branches, &gitea.Branch{Name: fields[0], Commit: &gitea.PayloadCommit{ID: fields[1]}})
+		}
+	}
+	writeJSON(w, http.StatusOK, branches)
+}
+
+func (s *Server) convert(owner string, name string, pr *PullRequest) *gitea.PullRequest {
+	now := time.Now()
+	repo := &gitea.Repository{
+		Owner:    &gitea.User{UserName: owner},
+		Name:     name,
+		FullName: owner + "/" + name,
+		CloneURL: fmt.Sprintf("%s/%s/%s", s.URL, owner, name),
+		HTMLURL:  fmt.Sprintf("%s/%s/%s", s.URL, owner, name),
+	}
+
+	var labels []*gitea.Label
+	for _, label := range pr.Labels {
+		labels = append(labels, &gitea.Label{Name: label})
+	}
+
+	var assignees []*gitea.User
+	for i, login := range pr.Assignees {
+		assignees = append(assignees, &gitea.User{ID: int64(i + 2), UserName: login})
+	}
+
+	var milestone *gitea.Milestone
+	if pr.Milestone != 0 {
+		milestone = &gitea.Milestone{ID: pr.Milestone, Title: fmt.Sprintf("milestone %d", pr.Milestone)}
+	}
+
+	state := gitea.StateOpen
+	if pr.Merged || pr.Closed {
+		state = gitea.StateClosed
+	}
+
+	var mergeSha *string
+	if pr.MergeSha != "" {
+		mergeSha = &pr.MergeSha
+	}
+
+	return &gitea.PullRequest{
+		Index:          int64(pr.Number),
+		MergedCommitID: mergeSha,
+		Poster:         user(),
+		Title:          pr.Title,
+		Body:           pr.Body,
+		Labels:         labels,
+		Assignees:      assignees,
+		Milestone:      milestone,
+		State:          state,
+		HTMLURL:        fmt.Sprintf("%s/%s/%s/pulls/%d", s.URL, owner, name, pr.Number),
+		HasMerged:      pr.Merged,
+		Base:           &gitea.PRBranchInfo{Name: pr.Base, Ref: pr.Base, Repository: repo},
+		Head:           &gitea.PRBranchInfo{Name: pr.Head, Ref: pr.Head, Repository: repo},
+		Created:        &now,
+		Updated:        &now,
+	}
+}
+
+func (r *repository) find(number int) *PullRequest {
+	for _, pr := range r.pulls {
+		if pr.Number == number {
+			return pr
+		}
+	}
+	return nil
+}
+
+func (r *repository) findComment(id int64) *gitea.Comment {
+	for _, comments := range r.comments {
+		for _, comment := range comments {
+			if comment.ID == id {
+				return comment
+			}
+		}
+	}
+	return nil
+}
+
+// issue returns the issue that a PR is.
+func issue(pr *gitea.PullRequest) *gitea.Issue {
+	return &gitea.Issue{
+		Index:     pr.Index,
+		Poster:    pr.Poster,
+		Title:     pr.Title,
+		Body:      pr.Body,
+		Labels:    pr.Labels,
+		Assignees: pr.Assignees,
+		Milestone: pr.Milestone,
+		State:     pr.State,
+		Created:   *pr.Created,
+		Updated:   *pr.Updated,
+	}
+}
+
+func user() *gitea.User {
+	return &gitea.User{ID: 1, UserName: "backport"}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
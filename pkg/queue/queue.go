@@ -0,0 +1,549 @@
+// Package queue runs backport jobs on a pool of workers, so that webhooks can be
+// acknowledged straight away and failed backports can be retried.
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/sirupsen/logrus"
+)
+
+// Status is the state of a job.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Job is the backport of a PR to a single branch.
+type Job struct {
+	ID     int64          `json:"id"`
+	Server service.Server `json:"server"`
+	Owner  string         `json:"owner"`
+	Repo   string         `json:"repo"`
+	PR     int            `json:"pr"`
+	Branch string         `json:"branch"`
+
+	// Batch is the id of the first job that was queued along with this one.
+	Batch int64 `json:"batch,omitempty"`
+
+	Status    Status                 `json:"status"`
+	Attempts  int                    `json:"attempts"`
+	LastError string                 `json:"lastError,omitempty"`
+	Result    service.BackportResult `json:"result"`
+	CreatedAt time.Time              `json:"createdAt"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+}
+
+// Key identifies the backport performed by the job, only one job per key can be
+// pending or running at a time.
+func (j *Job) Key() string {
+	return fmt.Sprintf("%s/%s/%s/%d/%s", j.Server.URL, j.Owner, j.Repo, j.PR, j.Branch)
+}
+
+// Handler performs the backport, returning what was done.
+type Handler func(job Job) (service.BackportResult, error)
+
+// Options configures the queue.
+type Options struct {
+	// Workers is the number of jobs that are run concurrently.
+	Workers int
+	// MaxAttempts is the number of times a job is tried before it fails.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubling for each retry after.
+	Backoff time.Duration
+	// Store persists the jobs, when nil the jobs are only held in memory.
+	Store Store
+	// Retention is how long a finished job is kept for, 0 keeps them.
+	Retention time.Duration
+	// Done, when set, is called with the jobs of a batch once they have all finished.
+	Done func(batch []Job)
+}
+
+// DefaultOptions returns the options used when none are configured.
+func DefaultOptions() Options {
+	return Options{Workers: 2, MaxAttempts: 3, Backoff: 30 * time.Second, Retention: 7 * 24 * time.Hour}
+}
+
+// OptionsFromEnv reads the options from $BACKPORT_WORKERS, $BACKPORT_MAX_ATTEMPTS,
+// $BACKPORT_RETRY_BACKOFF and $BACKPORT_JOB_RETENTION, using the defaults for any that
+// are not set. The jobs are stored in the bolt database at $BACKPORT_STORE_PATH when
+// it is set.
+func OptionsFromEnv() (Options, error) {
+	opts := DefaultOptions()
+
+	for name, value := range map[string]*int{"BACKPORT_WORKERS": &opts.Workers, "BACKPORT_MAX_ATTEMPTS": &opts.MaxAttempts} {
+		s := os.Getenv(name)
+		if s == "" {
+			continue
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 1 {
+			return opts, fmt.Errorf("invalid %s %s", name, s)
+		}
+		*value = i
+	}
+
+	if s := os.Getenv("BACKPORT_RETRY_BACKOFF"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid BACKPORT_RETRY_BACKOFF %s: %w", s, err)
+		}
+		opts.Backoff = d
+	}
+
+	if s := os.Getenv("BACKPORT_JOB_RETENTION"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid BACKPORT_JOB_RETENTION %s", s)
+		}
+		opts.Retention = d
+	}
+
+	if path := os.Getenv("BACKPORT_STORE_PATH"); path != "" {
+		store, err := NewBoltStore(path)
+		if err != nil {
+			return opts, fmt.Errorf("unable to open the job store %s: %w", path, err)
+		}
+		opts.Store = store
+	}
+
+	return opts, nil
+}
+
+// permanentError is an error that retrying will not fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as an error that retrying the job will not fix, e.g. a conflict.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Queue holds the jobs and runs them on its workers.
+type Queue struct {
+	handler Handler
+	opts    Options
+
+	mu     sync.Mutex
+	nextID int64
+	jobs   map[int64]*Job
+	active map[string]int64
+	// backported holds the job that succeeded for each key.
+	backported map[string]int64
+
+	// recovered is closed once the unfinished jobs have been resumed, until then no
+	// jobs are queued so that they cannot take the ids of the stored jobs.
+	recovered chan struct{}
+
+	ready  chan int64
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a queue that runs jobs with handler once started.
+func New(handler Handler, opts Options) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		handler:    handler,
+		opts:       opts,
+		jobs:       map[int64]*Job{},
+		active:     map[string]int64{},
+		backported: map[string]int64{},
+		recovered:  make(chan struct{}),
+		ready:      make(chan int64),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start resumes the unfinished jobs from the store and starts the workers.
+func (q *Queue) Start() error {
+	err := q.recover()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < q.opts.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return nil
+}
+
+// Ready reports whether the unfinished jobs have been resumed.
+func (q *Queue) Ready() bool {
+	select {
+	case <-q.recovered:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForRecovery blocks until the unfinished jobs have been resumed, or the queue
+// is stopped.
+func (q *Queue) waitForRecovery() {
+	select {
+	case <-q.recovered:
+	case <-q.ctx.Done():
+	}
+}
+
+// recover loads the jobs from the store, any that were pending or running when the
+// process stopped are run again.
+func (q *Queue) recover() error {
+	if q.opts.Store == nil {
+		close(q.recovered)
+		return nil
+	}
+
+	jobs, err := q.opts.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.prune(time.Now())
+
+	for i := range jobs {
+		job := &jobs[i]
+		q.jobs[job.ID] = job
+		if job.ID > q.nextID {
+			q.nextID = job.ID
+		}
+
+		if job.Status == StatusSucceeded {
+			q.backported[job.Key()] = job.ID
+		}
+
+		if job.Status == StatusPending || job.Status == StatusRunning {
+			logrus.WithField("Job", job.Key()).Infof("resuming job %d", job.ID)
+			job.Status = StatusPending
+			q.active[job.Key()] = job.ID
+			q.save(job)
+			q.schedule(job.ID, 0)
+		}
+	}
+
+	close(q.recovered)
+	return nil
+}
+
+// Stop stops the workers, waiting for any running jobs to finish.
+func (q *Queue) Stop() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Enqueue adds a job for the backport, returning false with the existing job if the
+// backport is already pending or running, or has already succeeded.
+func (q *Queue) Enqueue(server service.Server, owner string, repo string, pr int, branch string) (Job, bool) {
+	jobs, queued := q.EnqueueAll(server, owner, repo, pr, []string{branch})
+	return jobs[0], queued[0]
+}
+
+// EnqueueAll adds a job for the backport to each branch as a batch, returning the
+// job for each branch and whether it was queued. The existing job is returned for a
+// backport that is already pending or running, or has already succeeded, and it is
+// not part of the batch. The jobs are not queued until the stored jobs have been
+// resumed.
+func (q *Queue) EnqueueAll(server service.Server, owner string, repo string, pr int, branches []string) ([]Job, []bool) {
+	q.waitForRecovery()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var jobs []Job
+	var queued []bool
+	var batch int64
+	now := time.Now()
+	q.prune(now)
+	for _, branch := range branches {
+		job := &Job{
+			Server:    server,
+			Owner:     owner,
+			Repo:      repo,
+			PR:        pr,
+			Branch:    branch,
+			Status:    StatusPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		if id, ok := q.active[job.Key()]; ok {
+			jobs, queued = append(jobs, *q.jobs[id]), append(queued, false)
+			continue
+		}
+		if id, ok := q.backported[job.Key()]; ok {
+			jobs, queued = append(jobs, *q.jobs[id]), append(queued, false)
+			continue
+		}
+
+		q.nextID++
+		job.ID = q.nextID
+		if batch == 0 {
+			batch = job.ID
+		}
+		job.Batch = batch
+		q.jobs[job.ID] = job
+		q.active[job.Key()] = job.ID
+		q.save(job)
+
+		q.schedule(job.ID, 0)
+		jobs, queued = append(jobs, *job), append(queued, true)
+	}
+	return jobs, queued
+}
+
+// Cancel drops the pending job for the backport, and forgets that the backport has
+// succeeded so that it is run again if it is requested again. It returns the job that
+// is pending or running and whether it was dropped, a running job cannot be stopped.
+func (q *Queue) Cancel(server service.Server, owner string, repo string, pr int, branch string) (Job, bool) {
+	q.waitForRecovery()
+	q.mu.Lock()
+
+	job := &Job{Server: server, Owner: owner, Repo: repo, PR: pr, Branch: branch}
+	delete(q.backported, job.Key())
+
+	id, ok := q.active[job.Key()]
+	if !ok {
+		q.mu.Unlock()
+		return Job{}, false
+	}
+
+	job = q.jobs[id]
+	if job.Status != StatusPending {
+		q.mu.Unlock()
+		return *job, false
+	}
+
+	// the job is still scheduled, but will not be run once it is no longer pending
+	job.Status = StatusCancelled
+	job.UpdatedAt = time.Now()
+	delete(q.active, job.Key())
+	q.save(job)
+	logrus.WithField("Job", job.Key()).Infof("cancelled job %d", job.ID)
+
+	cancelled := *job
+	batch := q.finishedBatch(job.Batch)
+	q.mu.Unlock()
+
+	if batch != nil && q.opts.Done != nil {
+		q.opts.Done(batch)
+	}
+	return cancelled, true
+}
+
+// Forget forgets that the backport has succeeded, so that it is run again when it is
+// next queued.
+func (q *Queue) Forget(server service.Server, owner string, repo string, pr int, branch string) {
+	q.waitForRecovery()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := &Job{Server: server, Owner: owner, Repo: repo, PR: pr, Branch: branch}
+	delete(q.backported, job.Key())
+}
+
+// Get returns the job with the id.
+func (q *Queue) Get(id int64) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List returns all the jobs, oldest first.
+func (q *Queue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []Job{}
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// schedule hands the job to a worker after delay.
+func (q *Queue) schedule(id int64, delay time.Duration) {
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-q.ctx.Done():
+			return
+		}
+
+		select {
+		case q.ready <- id:
+		case <-q.ctx.Done():
+		}
+	}()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case id := <-q.ready:
+			q.run(id)
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *Queue) run(id int64) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	// a job that was cancelled while waiting to be retried may have been pruned
+	if !ok || job.Status != StatusPending {
+		q.mu.Unlock()
+		return
+	}
+	job.Status = StatusRunning
+	job.Attempts++
+	job.UpdatedAt = time.Now()
+	q.save(job)
+	snapshot := *job
+	q.mu.Unlock()
+
+	l := logrus.WithField("Job", snapshot.Key())
+	l.Infof("running attempt %d", snapshot.Attempts)
+
+	result, err := q.handler(snapshot)
+
+	batch := q.finish(l, job, result, err)
+	if batch != nil && q.opts.Done != nil {
+		q.opts.Done(batch)
+	}
+}
+
+// finish records the outcome of running the job, scheduling a retry if it failed
+// and can be retried. It returns the jobs of the job's batch once every one of
+// them has finished.
+func (q *Queue) finish(l *logrus.Entry, job *Job, result service.BackportResult, err error) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job.UpdatedAt = time.Now()
+	job.Result = result
+	if err == nil {
+		job.Status = StatusSucceeded
+		job.LastError = ""
+		delete(q.active, job.Key())
+		q.backported[job.Key()] = job.ID
+		q.save(job)
+		l.Infof("backported in PR-%d", result.Number)
+		return q.finishedBatch(job.Batch)
+	}
+
+	job.LastError = err.Error()
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || job.Attempts >= q.opts.MaxAttempts {
+		job.Status = StatusFailed
+		delete(q.active, job.Key())
+		q.save(job)
+		l.Errorf("failed after %d attempts: %v", job.Attempts, err)
+		return q.finishedBatch(job.Batch)
+	}
+
+	job.Status = StatusPending
+	q.save(job)
+	delay := q.opts.Backoff << (job.Attempts - 1)
+	l.Warnf("attempt %d failed, retrying in %s: %v", job.Attempts, delay, err)
+	q.schedule(job.ID, delay)
+	return nil
+}
+
+// finishedBatch returns the jobs of the batch, oldest first, or nil if any of them
+// are still pending or running. It must be called with q.mu held.
+func (q *Queue) finishedBatch(batch int64) []Job {
+	if batch == 0 {
+		return nil
+	}
+
+	var jobs []Job
+	for _, job := range q.jobs {
+		if job.Batch != batch {
+			continue
+		}
+		if job.Status == StatusPending || job.Status == StatusRunning {
+			return nil
+		}
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// prune removes the jobs that finished longer ago than the retention, along with
+// their saved copies. It must be called with q.mu held.
+func (q *Queue) prune(now time.Time) {
+	if q.opts.Retention <= 0 {
+		return
+	}
+
+	for id, job := range q.jobs {
+		if job.Status == StatusPending || job.Status == StatusRunning || now.Sub(job.UpdatedAt) <= q.opts.Retention {
+			continue
+		}
+
+		delete(q.jobs, id)
+		if q.backported[job.Key()] == id {
+			delete(q.backported, job.Key())
+		}
+		if q.opts.Store != nil {
+			err := q.opts.Store.Delete(id)
+			if err != nil {
+				logrus.WithField("Job", job.Key()).Errorf("unable to delete job %d: %v", id, err)
+			}
+		}
+	}
+}
+
+// save persists the job, the job carries on in memory if it cannot be saved.
+func (q *Queue) save(job *Job) {
+	if q.opts.Store == nil {
+		return
+	}
+
+	err := q.opts.Store.Save(*job)
+	if err != nil {
+		logrus.WithField("Job", job.Key()).Errorf("unable to save job %d: %v", job.ID, err)
+	}
+}
@@ -0,0 +1,405 @@
+package queue_test
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var server = service.Server{Driver: service.DriverGitHub, URL: "https://github.com"}
+
+func TestQueue(t *testing.T) {
+	type test struct {
+		name     string
+		errors   []error
+		status   queue.Status
+		attempts int
+		backport int
+	}
+
+	tests := []test{
+		{
+			name:     "succeeds",
+			status:   queue.StatusSucceeded,
+			attempts: 1,
+			backport: 2,
+		},
+		{
+			name:     "succeeds after a retry",
+			errors:   []error{errors.New("connection reset")},
+			status:   queue.StatusSucceeded,
+			attempts: 2,
+			backport: 2,
+		},
+		{
+			name:     "fails after the maximum attempts",
+			errors:   []error{errors.New("boom"), errors.New("boom"), errors.New("boom")},
+			status:   queue.StatusFailed,
+			attempts: 3,
+		},
+		{
+			name:     "permanent errors are not retried",
+			errors:   []error{queue.Permanent(errors.New("conflict"))},
+			status:   queue.StatusFailed,
+			attempts: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+
+			q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if attempts <= len(test.errors) {
+					return service.BackportResult{}, test.errors[attempts-1]
+				}
+				return service.BackportResult{Number: 2}, nil
+			}, queue.Options{Workers: 2, MaxAttempts: 3, Backoff: time.Millisecond})
+			require.NoError(t, q.Start())
+			defer q.Stop()
+
+			job, queued := q.Enqueue(server, "org", "repo", 1, "1.x")
+			require.True(t, queued)
+
+			job = waitFor(t, q, job.ID)
+			assert.Equal(t, test.status, job.Status)
+			assert.Equal(t, test.attempts, job.Attempts)
+			assert.Equal(t, test.backport, job.Result.Number)
+			if len(test.errors) >= test.attempts {
+				assert.Equal(t, test.errors[len(test.errors)-1].Error(), job.LastError)
+			}
+		})
+	}
+}
+
+func TestQueueIgnoresDuplicates(t *testing.T) {
+	release := make(chan struct{})
+	q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+		<-release
+		return service.BackportResult{Number: 2}, nil
+	}, queue.Options{Workers: 1, MaxAttempts: 1})
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	first, queued := q.Enqueue(server, "org", "repo", 1, "1.x")
+	require.True(t, queued)
+
+	duplicate, queued := q.Enqueue(server, "org", "repo", 1, "1.x")
+	assert.False(t, queued)
+	assert.Equal(t, first.ID, duplicate.ID)
+
+	other, queued := q.Enqueue(server, "org", "repo", 1, "2.x")
+	assert.True(t, queued)
+	assert.NotEqual(t, first.ID, other.ID)
+
+	close(release)
+	waitFor(t, q, first.ID)
+	waitFor(t, q, other.ID)
+	assert.Len(t, q.List(), 2)
+
+	// once backported, requesting the backport again is a no-op
+	again, queued := q.Enqueue(server, "org", "repo", 1, "1.x")
+	assert.False(t, queued)
+	assert.Equal(t, first.ID, again.ID)
+	assert.Len(t, q.List(), 2)
+
+	// unless the backport has been forgotten
+	q.Forget(server, "org", "repo", 1, "1.x")
+	again, queued = q.Enqueue(server, "org", "repo", 1, "1.x")
+	assert.True(t, queued)
+	assert.NotEqual(t, first.ID, again.ID)
+	waitFor(t, q, again.ID)
+}
+
+func waitFor(t *testing.T, q *queue.Queue, id int64) queue.Job {
+	t.Helper()
+
+	var job queue.Job
+	require.Eventually(t, func() bool {
+		job, _ = q.Get(id)
+		return job.Status == queue.StatusSucceeded || job.Status == queue.StatusFailed
+	}, 5*time.Second, time.Millisecond)
+	return job
+}
+
+func TestQueueResumesStoredJobs(t *testing.T) {
+	store, err := queue.NewBoltStore(filepath.Join(t.TempDir(), "jobs.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	for _, job := range []queue.Job{
+		{ID: 1, Server: server, Owner: "org", Repo: "repo", PR: 1, Branch: "1.x", Status: queue.StatusSucceeded, Attempts: 1, Result: service.BackportResult{Number: 2}},
+		{ID: 2, Server: server, Owner: "org", Repo: "repo", PR: 1, Branch: "2.x", Status: queue.StatusRunning, Attempts: 1},
+		{ID: 3, Server: server, Owner: "org", Repo: "repo", PR: 3, Branch: "1.x", Status: queue.StatusPending},
+	} {
+		require.NoError(t, store.Save(job))
+	}
+
+	var mu sync.Mutex
+	var ran []int64
+	q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, job.ID)
+		return service.BackportResult{Number: 10 + int(job.ID)}, nil
+	}, queue.Options{Workers: 1, MaxAttempts: 3, Store: store})
+	assert.False(t, q.Ready())
+
+	require.NoError(t, q.Start())
+	defer q.Stop()
+	assert.True(t, q.Ready())
+
+	assert.Equal(t, 2, waitFor(t, q, 1).Result.Number)
+	resumed := waitFor(t, q, 2)
+	assert.Equal(t, 12, resumed.Result.Number)
+	assert.Equal(t, 2, resumed.Attempts)
+	assert.Equal(t, 13, waitFor(t, q, 3).Result.Number)
+
+	job, queued := q.Enqueue(server, "org", "repo", 4, "1.x")
+	assert.True(t, queued)
+	assert.Equal(t, int64(4), job.ID)
+	waitFor(t, q, 4)
+
+	mu.Lock()
+	assert.ElementsMatch(t, []int64{2, 3, 4}, ran)
+	mu.Unlock()
+
+	// the results have been saved
+	jobs, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, jobs, 4)
+	for _, job := range jobs {
+		assert.Equal(t, queue.StatusSucceeded, job.Status)
+	}
+}
+
+func TestQueueWaitsForStoredJobs(t *testing.T) {
+	store, err := queue.NewBoltStore(filepath.Join(t.TempDir(), "jobs.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Save(queue.Job{ID: 1, Server: server, Owner: "org", Repo: "repo", PR: 1, Branch: "1.x", Status: queue.StatusPending}))
+
+	var mu sync.Mutex
+	var ran []int64
+	q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, job.ID)
+		return service.BackportResult{}, nil
+	}, queue.Options{Workers: 1, MaxAttempts: 1, Store: store})
+	defer q.Stop()
+
+	// a webhook arrives before the stored jobs have been resumed
+	enqueued := make(chan queue.Job)
+	go func() {
+		job, _ := q.Enqueue(server, "org", "repo", 2, "1.x")
+		enqueued <- job
+	}()
+
+	select {
+	case <-enqueued:
+		t.Fatal("the job was queued before the stored jobs were resumed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, q.Start())
+	job := <-enqueued
+	assert.Equal(t, int64(2), job.ID)
+	waitFor(t, q, 1)
+	waitFor(t, q, 2)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.ElementsMatch(t, []int64{1, 2}, ran)
+}
+
+func TestQueuePrunesFinishedJobs(t *testing.T) {
+	store, err := queue.NewBoltStore(filepath.Join(t.TempDir(), "jobs.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Now()
+	for _, job := range []queue.Job{
+		{ID: 1, Server: server, Owner: "org", Repo: "repo", PR: 1, Branch: "1.x", Status: queue.StatusSucceeded, UpdatedAt: now.Add(-48 * time.Hour)},
+		{ID: 2, Server: server, Owner: "org", Repo: "repo", PR: 1, Branch: "2.x", Status: queue.StatusFailed, UpdatedAt: now.Add(-time.Hour)},
+	} {
+		require.NoError(t, store.Save(job))
+	}
+
+	q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+		return service.BackportResult{}, nil
+	}, queue.Options{Workers: 1, MaxAttempts: 1, Store: store, Retention: 24 * time.Hour})
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	jobs := q.List()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, int64(2), jobs[0].ID)
+
+	stored, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	assert.Equal(t, int64(2), stored[0].ID)
+
+	// the backport is forgotten along with the job that succeeded
+	job, queued := q.Enqueue(server, "org", "repo", 1, "1.x")
+	assert.True(t, queued)
+	waitFor(t, q, job.ID)
+}
+
+func TestQueuePrunesCancelledRetry(t *testing.T) {
+	attempts := make(chan int64, 10)
+	q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+		attempts <- job.ID
+		return service.BackportResult{}, errors.New("unable to push")
+	}, queue.Options{Workers: 1, MaxAttempts: 3, Backoff: 100 * time.Millisecond, Retention: time.Millisecond})
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	job, _ := q.Enqueue(server, "org", "repo", 1, "1.x")
+	assert.Equal(t, job.ID, <-attempts)
+	require.Eventually(t, func() bool {
+		job, _ := q.Get(job.ID)
+		return job.Status == queue.StatusPending
+	}, 5*time.Second, time.Millisecond)
+
+	// the job is cancelled while it waits to be retried, and then pruned
+	_, cancelled := q.Cancel(server, "org", "repo", 1, "1.x")
+	require.True(t, cancelled)
+	time.Sleep(10 * time.Millisecond)
+	other, _ := q.Enqueue(server, "org", "repo", 2, "1.x")
+	assert.Equal(t, other.ID, <-attempts)
+	_, ok := q.Get(job.ID)
+	assert.False(t, ok)
+
+	// the retry that was scheduled finds nothing to run
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case id := <-attempts:
+		assert.Equal(t, other.ID, id)
+	default:
+	}
+}
+
+func TestQueueReportsBatches(t *testing.T) {
+	done := make(chan []queue.Job, 1)
+	q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+		if job.Branch == "2.x" {
+			return service.BackportResult{}, queue.Permanent(errors.New("conflict"))
+		}
+		return service.BackportResult{Number: int(job.ID) + 10}, nil
+	}, queue.Options{Workers: 2, MaxAttempts: 1, Done: func(batch []queue.Job) {
+		done <- batch
+	}})
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	jobs, queued := q.EnqueueAll(server, "org", "repo", 1, []string{"1.x", "2.x", "3.x"})
+	assert.Equal(t, []bool{true, true, true}, queued)
+
+	var batch []queue.Job
+	select {
+	case batch = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the batch was not reported")
+	}
+
+	require.Len(t, batch, 3)
+	for i, job := range batch {
+		assert.Equal(t, jobs[i].ID, job.ID)
+		assert.Equal(t, jobs[0].ID, job.Batch)
+	}
+	assert.Equal(t, queue.StatusSucceeded, batch[0].Status)
+	assert.Equal(t, 11, batch[0].Result.Number)
+	assert.Equal(t, queue.StatusFailed, batch[1].Status)
+	assert.Equal(t, "conflict", batch[1].LastError)
+	assert.Equal(t, queue.StatusSucceeded, batch[2].Status)
+
+	// backports that are already done are not part of a new batch
+	jobs, queued = q.EnqueueAll(server, "org", "repo", 1, []string{"1.x", "4.x"})
+	assert.Equal(t, []bool{false, true}, queued)
+	batch = <-done
+	require.Len(t, batch, 1)
+	assert.Equal(t, jobs[1].ID, batch[0].ID)
+}
+
+func TestQueueCancelsPendingJobs(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan []queue.Job, 3)
+
+	var mu sync.Mutex
+	var ran []string
+	q := queue.New(func(job queue.Job) (service.BackportResult, error) {
+		mu.Lock()
+		ran = append(ran, job.Branch)
+		mu.Unlock()
+		<-release
+		return service.BackportResult{Number: 2}, nil
+	}, queue.Options{Workers: 1, MaxAttempts: 1, Done: func(batch []queue.Job) {
+		done <- batch
+	}})
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	jobs, _ := q.EnqueueAll(server, "org", "repo", 1, []string{"1.x", "2.x"})
+
+	// with a single worker one job runs while the other waits
+	var running, pending queue.Job
+	require.Eventually(t, func() bool {
+		first, _ := q.Get(jobs[0].ID)
+		second, _ := q.Get(jobs[1].ID)
+		if second.Status == queue.StatusRunning {
+			first, second = second, first
+		}
+		running, pending = first, second
+		return running.Status == queue.StatusRunning
+	}, 5*time.Second, time.Millisecond)
+
+	// the running job carries on, the pending one is dropped
+	job, cancelled := q.Cancel(server, "org", "repo", 1, running.Branch)
+	assert.False(t, cancelled)
+	assert.Equal(t, queue.StatusRunning, job.Status)
+
+	job, cancelled = q.Cancel(server, "org", "repo", 1, pending.Branch)
+	assert.True(t, cancelled)
+	assert.Equal(t, pending.ID, job.ID)
+	assert.Equal(t, queue.StatusCancelled, job.Status)
+
+	_, cancelled = q.Cancel(server, "org", "repo", 1, "3.x")
+	assert.False(t, cancelled)
+
+	close(release)
+	batch := <-done
+	require.Len(t, batch, 2)
+	for _, job := range batch {
+		if job.ID == running.ID {
+			assert.Equal(t, queue.StatusSucceeded, job.Status)
+		} else {
+			assert.Equal(t, queue.StatusCancelled, job.Status)
+		}
+	}
+
+	mu.Lock()
+	assert.Equal(t, []string{running.Branch}, ran)
+	mu.Unlock()
+
+	// a cancelled backport is run again when it is requested again
+	_, queued := q.Enqueue(server, "org", "repo", 1, pending.Branch)
+	assert.True(t, queued)
+	q.Cancel(server, "org", "repo", 1, running.Branch)
+	_, queued = q.Enqueue(server, "org", "repo", 1, running.Branch)
+	assert.True(t, queued)
+}
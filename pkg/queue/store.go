@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store persists jobs so that they survive a restart.
+type Store interface {
+	// Save creates or updates the job.
+	Save(job Job) error
+	// Load returns all the saved jobs.
+	Load() ([]Job, error)
+	// Delete removes the job.
+	Delete(id int64) error
+}
+
+var jobsBucket = []byte("jobs")
+
+// BoltStore is a Store backed by a bolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens, or creates, the bolt database at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Save creates or updates the job.
+func (s *BoltStore) Save(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put(key(job.ID), data)
+	})
+}
+
+// Load returns all the saved jobs, oldest first.
+func (s *BoltStore) Load() ([]Job, error) {
+	var jobs []Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_ []byte, data []byte) error {
+			var job Job
+			err := json.Unmarshal(data, &job)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// Delete removes the job.
+func (s *BoltStore) Delete(id int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete(key(id))
+	})
+}
+
+// Close closes the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// key encodes the id big endian so that the jobs are iterated in order.
+func key(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
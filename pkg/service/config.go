@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigPath is the path of a repository's configuration, which is read from its
+// default branch.
+const ConfigPath = ".github/backport.yml"
+
+// The ways a repository can handle a cherry-pick that conflicts.
+const (
+	// ConflictsFail fails the backport.
+	ConflictsFail = "fail"
+	// ConflictsDraft opens a draft PR with the conflicts committed.
+	ConflictsDraft = "draft"
+)
+
+// RepoConfig configures the backports of a repository, anything it leaves out is
+// taken from the service's options.
+type RepoConfig struct {
+	// Branches are the patterns, as for path.Match, of the branches that can be
+	// backported to, any branch when there are none.
+	Branches []string `json:"branches,omitempty"`
+
+	// LabelPrefix prefixes the branch in the labels that request a backport,
+	// defaults to LabelPrefix.
+	LabelPrefix string `json:"labelPrefix,omitempty"`
+
+	// Templates override the templates of the backport branch, PR and trailers.
+	Templates TemplatesConfig `json:"templates,omitempty"`
+
+	// RequiredApprovals is the number of approvals a PR needs before it is backported.
+	RequiredApprovals int `json:"requiredApprovals,omitempty"`
+
+	// Conflicts is ConflictsFail or ConflictsDraft.
+	Conflicts string `json:"conflicts,omitempty"`
+
+	// Copy lists the fields of the source PR that are copied to the backport PR.
+	Copy *[]string `json:"copy,omitempty"`
+
+	// Permission is the minimum permission on the repository needed to request
+	// backports with a comment.
+	Permission string `json:"permission,omitempty"`
+
+	// Teams are the teams, as org/team, whose members can request backports whatever
+	// their permission on the repository.
+	Teams *[]string `json:"teams,omitempty"`
+
+	// CloseCancelled closes the backport PR when its backport is cancelled.
+	CloseCancelled *bool `json:"closeCancelled,omitempty"`
+}
+
+// TemplatesConfig holds the text of the templates a repository overrides.
+type TemplatesConfig struct {
+	Branch   string    `json:"branch,omitempty"`
+	Title    string    `json:"title,omitempty"`
+	Body     string    `json:"body,omitempty"`
+	Trailers *[]string `json:"trailers,omitempty"`
+}
+
+// ParseRepoConfig parses and validates a repository's configuration.
+func ParseRepoConfig(data []byte) (*RepoConfig, error) {
+	config := &RepoConfig{}
+	err := yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range config.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid branch pattern %q: %w", pattern, err)
+		}
+	}
+
+	if config.RequiredApprovals < 0 {
+		return nil, fmt.Errorf("invalid requiredApprovals %d", config.RequiredApprovals)
+	}
+
+	switch config.Conflicts {
+	case "", ConflictsFail, ConflictsDraft:
+	default:
+		return nil, fmt.Errorf("invalid conflicts %q, expected %s or %s", config.Conflicts, ConflictsFail, ConflictsDraft)
+	}
+
+	if config.Copy != nil {
+		if err := validateCopy(*config.Copy); err != nil {
+			return nil, fmt.Errorf("invalid copy: %w", err)
+		}
+	}
+
+	if err := validatePermission(config.Permission); err != nil {
+		return nil, fmt.Errorf("invalid permission: %w", err)
+	}
+
+	if config.Teams != nil {
+		if _, err := parseTeams(*config.Teams); err != nil {
+			return nil, fmt.Errorf("invalid teams: %w", err)
+		}
+	}
+
+	// the templates are checked when they are parsed
+	_, err = config.Options(BackportOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Prefix returns the prefix of the labels that request a backport.
+func (c *RepoConfig) Prefix() string {
+	if c.LabelPrefix != "" {
+		return c.LabelPrefix
+	}
+	return LabelPrefix
+}
+
+// AllowsBranch reports whether branch can be backported to.
+func (c *RepoConfig) AllowsBranch(branch string) bool {
+	if len(c.Branches) == 0 {
+		return true
+	}
+	for _, pattern := range c.Branches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorization returns who can request backports of the repository's PRs, which is
+// the service's authorization with the repository's configuration applied.
+func (c *RepoConfig) Authorization(a Authorization) Authorization {
+	if c.Permission != "" {
+		a.Permission = c.Permission
+	}
+	if c.Teams != nil {
+		a.Teams = *c.Teams
+	}
+	return a
+}
+
+// Options returns the options used to backport the repository's PRs, which are the
+// service's options with the repository's configuration applied.
+func (c *RepoConfig) Options(opts BackportOptions) (BackportOptions, error) {
+	switch c.Conflicts {
+	case ConflictsFail:
+		opts.AllowConflicts = false
+	case ConflictsDraft:
+		opts.AllowConflicts = true
+	}
+
+	if c.Copy != nil {
+		opts.Copy = *c.Copy
+		opts.RepoCopy = nil
+	}
+
+	opts.LabelPrefix = c.Prefix()
+
+	if c.CloseCancelled != nil {
+		opts.CloseCancelled = *c.CloseCancelled
+	}
+
+	t := c.Templates
+	if t.Branch != "" || t.Title != "" || t.Body != "" || t.Trailers != nil {
+		templates, err := opts.templates().Override(t.Branch, t.Title, t.Body, t.Trailers)
+		if err != nil {
+			return opts, err
+		}
+		opts.Templates = templates
+	}
+
+	return opts, nil
+}
+
+// FindDefaultBranchSha returns the commit at the head of the repository's default
+// branch.
+func (s *scmImpl) FindDefaultBranchSha(owner string, repo string) (string, error) {
+	fullName := fmt.Sprintf("%s/%s", owner, repo)
+	repository, _, err := s.client.Repositories.Find(context.Background(), fullName)
+	if err != nil {
+		return "", err
+	}
+
+	branch, _, err := s.client.Git.FindBranch(context.Background(), fullName, repository.Branch)
+	if err != nil {
+		return "", err
+	}
+	return branch.Sha, nil
+}
+
+// ReadFileFromRepo returns the contents of the file at ref, or nil if there is no
+// such file.
+func (s *scmImpl) ReadFileFromRepo(owner string, repo string, path string, ref string) ([]byte, error) {
+	content, resp, err := s.client.Contents.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), path, ref)
+	if resp != nil && resp.Status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		if scm.IsScmNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return content.Data, nil
+}
+
+// CountApprovalsForPr returns the number of users whose latest review of pr
+// approved it.
+func (s *scmImpl) CountApprovalsForPr(owner string, repo string, pr int) (int, error) {
+	switch s.server.Driver {
+	case DriverGitLab:
+		return s.countGitLabApprovals(owner, repo, pr)
+	case DriverBitbucketServer:
+		return s.countStashApprovals(owner, repo, pr)
+	}
+
+	// the reviews are listed oldest first
+	approved := map[string]bool{}
+	opts := &scm.ListOptions{Page: 1, Size: 100}
+	for {
+		reviews, resp, err := s.client.Reviews.List(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, opts)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, review := range reviews {
+			switch review.State {
+			case scm.ReviewStateApproved:
+				approved[review.Author.Login] = true
+			case scm.ReviewStateChangesRequested, scm.ReviewStateDismissed, "REQUEST_CHANGES":
+				approved[review.Author.Login] = false
+			}
+		}
+
+		if resp == nil || resp.Page.Next == 0 {
+			break
+		}
+		opts.Page = resp.Page.Next
+	}
+
+	count := 0
+	for _, ok := range approved {
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// countGitLabApprovals counts the approvals of a merge request, which the gitlab
+// driver does not support.
+func (s *scmImpl) countGitLabApprovals(owner string, repo string, pr int) (int, error) {
+	var approvals struct {
+		ApprovedBy []json.RawMessage `json:"approved_by"`
+	}
+	err := s.getJSON(fmt.Sprintf("api/v4/projects/%s/merge_requests/%d/approvals", url.PathEscape(owner+"/"+repo), pr), &approvals)
+	return len(approvals.ApprovedBy), err
+}
+
+// countStashApprovals counts the reviewers that approved a PR, which the bitbucket
+// server driver does not support.
+func (s *scmImpl) countStashApprovals(owner string, repo string, pr int) (int, error) {
+	var pullRequest struct {
+		Reviewers []struct {
+			Approved bool `json:"approved"`
+		} `json:"reviewers"`
+	}
+	err := s.getJSON(fmt.Sprintf("rest/api/1.0/projects/%s/repos/%s/pull-requests/%d", owner, repo, pr), &pullRequest)
+
+	count := 0
+	for _, reviewer := range pullRequest.Reviewers {
+		if reviewer.Approved {
+			count++
+		}
+	}
+	return count, err
+}
+
+// getJSON decodes the response to a GET of path into v.
+func (s *scmImpl) getJSON(path string, v interface{}) error {
+	resp, err := s.client.Do(context.Background(), &scm.Request{Method: "GET", Path: path})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.Status == http.StatusNotFound {
+		return fmt.Errorf("unable to get %s: %w", path, scm.ErrNotFound)
+	}
+	if resp.Status != http.StatusOK {
+		return fmt.Errorf("unable to get %s: %d %s", path, resp.Status, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,115 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/jenkins-x/go-scm/scm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRepoConfig(t *testing.T) {
+	type test struct {
+		name             string
+		config           string
+		allowed          []string
+		notAllowed       []string
+		expectedPrefix   string
+		expectedConflict bool
+		expectedCopy     []string
+		expectedBranch   string
+		expectedError    string
+	}
+
+	tests := []test{
+		{
+			name:           "empty",
+			allowed:        []string{"main", "1.x"},
+			expectedPrefix: "Backport to ",
+			expectedCopy:   service.DefaultCopy,
+			expectedBranch: "backport-PR-1-to-1.x",
+		},
+		{
+			name: "everything",
+			config: `branches: ["release-*", "1.*"]
+labelPrefix: backport/
+templates:
+  branch: "backport/{{.PR.Number}}/{{.Branch}}"
+  trailers: []
+requiredApprovals: 1
+conflicts: draft
+copy: [labels]
+`,
+			allowed:          []string{"release-1", "1.x"},
+			notAllowed:       []string{"main", "2.x"},
+			expectedPrefix:   "backport/",
+			expectedConflict: true,
+			expectedCopy:     []string{"labels"},
+			expectedBranch:   "backport/1/1.x",
+		},
+		{
+			name:          "unknown key",
+			config:        "branch: main\n",
+			expectedError: `error unmarshaling JSON: while decoding JSON: json: unknown field "branch"`,
+		},
+		{
+			name:          "invalid branch pattern",
+			config:        "branches: [\"[\"]\n",
+			expectedError: `invalid branch pattern "[": syntax error in pattern`,
+		},
+		{
+			name:          "negative approvals",
+			config:        "requiredApprovals: -1\n",
+			expectedError: "invalid requiredApprovals -1",
+		},
+		{
+			name:          "unknown copy field",
+			config:        "copy: [title, colour]\n",
+			expectedError: "invalid copy: unknown field colour, expected one of title, body, labels, assignees, milestone, reviewers",
+		},
+		{
+			name:          "unknown permission",
+			config:        "permission: read\n",
+			expectedError: "invalid permission: unknown permission read, expected write, maintain or admin",
+		},
+		{
+			name:          "team without an org",
+			config:        "teams: [release]\n",
+			expectedError: "invalid teams: team release is not org/team",
+		},
+		{
+			name:          "invalid branch template",
+			config:        "templates:\n  branch: \"{{.Branch}}..\"\n",
+			expectedError: `invalid branch template "{{.Branch}}..": "1.x.." is not a valid branch name`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := service.ParseRepoConfig([]byte(test.config))
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+
+			for _, branch := range test.allowed {
+				assert.True(t, config.AllowsBranch(branch), branch)
+			}
+			for _, branch := range test.notAllowed {
+				assert.False(t, config.AllowsBranch(branch), branch)
+			}
+
+			opts, err := config.Options(service.BackportOptions{Copy: service.DefaultCopy, Templates: service.DefaultTemplates})
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedPrefix, config.Prefix())
+			assert.Equal(t, test.expectedConflict, opts.AllowConflicts)
+			assert.Equal(t, test.expectedCopy, opts.CopyFor("org", "repo"))
+
+			branch, err := opts.Templates.BranchName(service.TemplateData{PR: &scm.PullRequest{Number: 1}, Branch: "1.x"})
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedBranch, branch)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jenkins-x/go-scm/scm"
+)
+
+// ConflictLabel is added to a backport PR whose conflicts need resolving by hand.
+const ConflictLabel = "needs manual resolution"
+
+// conflict describes a cherry-pick whose conflicts were committed.
+type conflict struct {
+	// Commit is the commit that failed to cherry-pick.
+	Commit string
+	// Files are the files that conflicted.
+	Files []string
+	// Remaining are the commits after Commit that have not been cherry-picked.
+	Remaining []string
+}
+
+// description explains what needs resolving, for the body of the backport PR.
+func (c *conflict) description() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "The cherry-pick of %s conflicted, the conflicts have been committed and need resolving by hand.\n\n", c.Commit)
+	b.WriteString("Conflicting files:\n")
+	for _, file := range c.Files {
+		fmt.Fprintf(&b, "- `%s`\n", file)
+	}
+
+	if len(c.Remaining) > 0 {
+		b.WriteString("\nCommits that still need cherry-picking:\n")
+		for _, commit := range c.Remaining {
+			fmt.Fprintf(&b, "- %s\n", commit)
+		}
+	}
+	return b.String()
+}
+
+// commitConflicts commits the conflicted cherry-pick of commit, markers and all, so
+// that it can be resolved on the backport branch. If nothing conflicted the
+// cherry-pick failed for another reason and cherryPickErr is returned.
+func commitConflicts(gitter *observableGitter, dir string, commit string, remaining []string, cherryPickErr error) (*conflict, error) {
+	out, err := gitter.ExecuteGit(dir, "diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range strings.Split(out, "\n") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, cherryPickErr
+	}
+
+	_, err = gitter.ExecuteGit(dir, "add", "--all")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = gitter.ExecuteGit(dir, "commit", "--no-edit", "--no-verify")
+	if err != nil {
+		return nil, err
+	}
+
+	return &conflict{Commit: commit, Files: files, Remaining: remaining}, nil
+}
+
+// createPullRequest creates the PR, as a draft if draft is set.
+func (s *scmImpl) createPullRequest(owner string, repo string, input *scm.PullRequestInput, draft bool) (*scm.PullRequest, error) {
+	if draft {
+		switch s.server.Driver {
+		case DriverGitHub:
+			return s.createGitHubDraftPullRequest(owner, repo, input)
+		case DriverGitea:
+			input.Title = "WIP: " + input.Title
+		default:
+			// gitlab treats the prefix as marking a draft, bitbucket server just shows it
+			input.Title = "Draft: " + input.Title
+		}
+	}
+
+	pullRequest, _, err := s.client.PullRequests.Create(context.Background(), fmt.Sprintf("%s/%s", owner, repo), input)
+	return pullRequest, err
+}
+
+type draftPullRequest struct {
+	Title string `json:"title"`
+	Head  string `json:"head"`
+	Base  string `json:"base"`
+	Body  string `json:"body"`
+	Draft bool   `json:"draft"`
+}
+
+// createGitHubDraftPullRequest creates a draft PR, which the github driver does not support.
+func (s *scmImpl) createGitHubDraftPullRequest(owner string, repo string, input *scm.PullRequestInput) (*scm.PullRequest, error) {
+	data, err := json.Marshal(draftPullRequest{
+		Title: input.Title,
+		Head:  input.Head,
+		Base:  input.Base,
+		Body:  input.Body,
+		Draft: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("repos/%s/%s/pulls", owner, repo)
+	req := &scm.Request{Method: "POST", Path: path, Body: bytes.NewReader(data)}
+	resp, err := s.client.Do(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != http.StatusCreated {
+		return nil, fmt.Errorf("unable to create a draft PR for %s/%s: %d %s", owner, repo, resp.Status, body)
+	}
+
+	var created struct {
+		Number int `json:"number"`
+	}
+	err = json.Unmarshal(body, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	pullRequest, _, err := s.client.PullRequests.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), created.Number)
+	return pullRequest, err
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+)
+
+type commit struct {
+	Sha string `json:"sha"`
+}
+
+// listGiteaCommitsForPr lists the commits of a PR, which the gitea driver does not support.
+func (s *scmImpl) listGiteaCommitsForPr(owner string, repo string, pr int) ([]string, error) {
+	path := fmt.Sprintf("api/v1/repos/%s/%s/pulls/%d/commits", owner, repo, pr)
+	req := &scm.Request{Method: "GET", Path: path, Body: nil}
+	resp, err := s.client.Do(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.Status != http.StatusOK {
+		return nil, fmt.Errorf("unable to list commits for %s/%s/pulls/%d: %d", owner, repo, pr, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []commit
+	err = json.Unmarshal(body, &commits)
+	if err != nil {
+		return nil, err
+	}
+
+	var c []string
+	for _, commit := range commits {
+		c = append(c, commit.Sha)
+	}
+
+	logrus.Infof("got commits %s", c)
+	return c, nil
+}
@@ -0,0 +1,577 @@
+package service_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/giteatest"
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGiteaBackport(t *testing.T) {
+	root := t.TempDir()
+	server, err := giteatest.NewServer(filepath.Join(root, "server"))
+	require.NoError(t, err)
+	defer server.Close()
+
+	bare, err := server.CreateRepo("org", "repo")
+	require.NoError(t, err)
+
+	// main has a release branch cut from it, followed by the fix that needs backporting
+	work := filepath.Join(root, "work")
+	git(t, root, "clone", bare, work)
+	writeFile(t, work, "README.md", "hello\n")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-m", "initial commit")
+	git(t, work, "branch", "1.x")
+	writeFile(t, work, "fix.txt", "fixed\n")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-m", "fix a bug")
+	fix := strings.TrimSpace(git(t, work, "rev-parse", "HEAD"))
+	git(t, work, "push", "origin", "main", "1.x")
+
+	// an earlier attempt pushed the backport branch but failed to create the PR
+	git(t, work, "checkout", "-b", "backport-PR-1-to-1.x", "1.x")
+	writeFile(t, work, "stale.txt", "stale\n")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-m", "stale attempt")
+	git(t, work, "push", "origin", "backport-PR-1-to-1.x")
+
+	server.AddPullRequest("org", "repo", giteatest.PullRequest{
+		Number:  1,
+		Title:   "Fix a bug",
+		Head:    "fix",
+		Base:    "main",
+		Merged:  true,
+		Labels:  []string{"Backport to 1.x"},
+		Commits: []string{fix},
+	})
+
+	s := service.NewScm(service.Server{Driver: service.DriverGitea, URL: server.URL}, "backport", "token")
+
+	branches, err := s.ListBranchesForRepo("org", "repo")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"main", "1.x", "backport-PR-1-to-1.x"}, branches)
+
+	merged, err := s.IsPrMerged("org", "repo", 1)
+	require.NoError(t, err)
+	assert.True(t, merged)
+
+	targets, err := s.DetermineBranchesForPr("org", "repo", 1, service.LabelPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.x"}, targets)
+
+	commits, err := s.ListCommitsForPr("org", "repo", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{fix}, commits)
+
+	result, err := s.ApplyCommitsToRepo("org", "repo", 1, "1.x", commits, service.BackportOptions{})
+	require.NoError(t, err)
+
+	// the fix has been pushed to the backport branch, on top of the release branch
+	log := git(t, bare, "log", "--format=%s", "1.x..backport-PR-1-to-1.x")
+	assert.Equal(t, "fix a bug\n", log)
+
+	backport, err := s.FindBackportPr("org", "repo", 1, "1.x", service.BackportOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, backport)
+	assert.Equal(t, 2, backport.Number)
+
+	prs := server.PullRequests("org", "repo")
+	require.Len(t, prs, 2)
+	assert.Equal(t, "backport-PR-1-to-1.x", prs[1].Head)
+	assert.Equal(t, "1.x", prs[1].Base)
+
+	assert.Equal(t, 2, result.Number)
+	assert.Equal(t, server.URL+"/org/repo/pulls/2", result.Link)
+	assert.False(t, result.Updated)
+	assert.Contains(t, result.Log, "git push --force-with-lease origin backport-PR-1-to-1.x")
+
+	// the caller reports the result
+	assert.Empty(t, server.Comments("org", "repo", 1))
+
+	// backporting again updates the existing PR rather than failing
+	result, err = s.ApplyCommitsToRepo("org", "repo", 1, "1.x", commits, service.BackportOptions{})
+	require.NoError(t, err)
+
+	assert.Len(t, server.PullRequests("org", "repo"), 2)
+	assert.Equal(t, 2, result.Number)
+	assert.True(t, result.Updated)
+
+	// a backport PR that was closed without being merged is replaced with a new one
+	require.NoError(t, s.ClosePr("org", "repo", 2))
+	result, err = s.ApplyCommitsToRepo("org", "repo", 1, "1.x", commits, service.BackportOptions{})
+	require.NoError(t, err)
+
+	assert.Len(t, server.PullRequests("org", "repo"), 3)
+	assert.Equal(t, 3, result.Number)
+	assert.False(t, result.Updated)
+
+	backport, err = s.FindBackportPr("org", "repo", 1, "1.x", service.BackportOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, backport)
+	assert.Equal(t, 3, backport.Number)
+}
+
+func TestGiteaConflictingBackport(t *testing.T) {
+	root := t.TempDir()
+	server, err := giteatest.NewServer(filepath.Join(root, "server"))
+	require.NoError(t, err)
+	defer server.Close()
+
+	bare, err := server.CreateRepo("org", "repo")
+	require.NoError(t, err)
+
+	// the release branch has changed the same line as the fix
+	work := filepath.Join(root, "work")
+	git(t, root, "clone", bare, work)
+	writeFile(t, work, "README.md", "hello\n")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-m", "initial commit")
+	git(t, work, "checkout", "-b", "1.x")
+	writeFile(t, work, "README.md", "hello 1.x\n")
+	git(t, work, "commit", "-am", "release 1.x")
+	git(t, work, "checkout", "main")
+	writeFile(t, work, "README.md", "hello fixed\n")
+	git(t, work, "commit", "-am", "fix a bug")
+	fix := strings.TrimSpace(git(t, work, "rev-parse", "HEAD"))
+	writeFile(t, work, "test.txt", "tested\n")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-m", "test the fix")
+	test := strings.TrimSpace(git(t, work, "rev-parse", "HEAD"))
+	git(t, work, "push", "origin", "main", "1.x")
+
+	server.AddPullRequest("org", "repo", giteatest.PullRequest{
+		Number:  1,
+		Title:   "Fix a bug",
+		Head:    "fix",
+		Base:    "main",
+		Merged:  true,
+		Commits: []string{fix, test},
+	})
+
+	s := service.NewScm(service.Server{Driver: service.DriverGitea, URL: server.URL}, "backport", "token")
+
+	// by default the backport gives up
+	result, err := s.ApplyCommitsToRepo("org", "repo", 1, "1.x", []string{fix, test}, service.BackportOptions{})
+	var cherryPickErr *service.CherryPickError
+	require.ErrorAs(t, err, &cherryPickErr)
+	assert.Equal(t, fix, cherryPickErr.Commit)
+	assert.Len(t, server.PullRequests("org", "repo"), 1)
+	assert.Contains(t, result.Log, "git cherry-pick -x "+fix)
+
+	result, err = s.ApplyCommitsToRepo("org", "repo", 1, "1.x", []string{fix, test}, service.BackportOptions{AllowConflicts: true})
+	require.NoError(t, err)
+
+	// the conflict is committed for resolving by hand, leaving the test to be picked after
+	readme := git(t, bare, "show", "backport-PR-1-to-1.x:README.md")
+	assert.Contains(t, readme, "<<<<<<<")
+	log := git(t, bare, "log", "--format=%s", "1.x..backport-PR-1-to-1.x")
+	assert.Equal(t, "fix a bug\n", log)
+
+	prs := server.PullRequests("org", "repo")
+	require.Len(t, prs, 2)
+	assert.Equal(t, "WIP: Backporting PR-1 to 1.x", prs[1].Title)
+	assert.Equal(t, []string{service.ConflictLabel}, prs[1].Labels)
+	assert.Contains(t, prs[1].Body, "The cherry-pick of "+fix+" conflicted")
+	assert.Contains(t, prs[1].Body, "- `README.md`")
+	assert.Contains(t, prs[1].Body, "Commits that still need cherry-picking:\n- "+test)
+
+	assert.Equal(t, server.URL+"/org/repo/pulls/2", result.Link)
+	assert.Equal(t, fix, result.Conflict)
+}
+
+func TestGiteaProvenance(t *testing.T) {
+	root := t.TempDir()
+	server, err := giteatest.NewServer(filepath.Join(root, "server"))
+	require.NoError(t, err)
+	defer server.Close()
+
+	bare, err := server.CreateRepo("org", "repo")
+	require.NoError(t, err)
+
+	work := filepath.Join(root, "work")
+	git(t, root, "clone", bare, work)
+	writeFile(t, work, "README.md", "hello\n")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-m", "initial commit")
+	git(t, work, "branch", "1.x")
+	writeFile(t, work, "fix.txt", "fixed\n")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-m", "fix a bug")
+	fix := head(t, work)
+	git(t, work, "push", "origin", "main", "1.x")
+
+	server.AddPullRequest("org", "repo", giteatest.PullRequest{
+		Number:  1,
+		Title:   "Fix a bug",
+		Head:    "fix",
+		Base:    "main",
+		Merged:  true,
+		Commits: []string{fix},
+	})
+
+	s := service.NewScm(service.Server{Driver: service.DriverGitea, URL: server.URL}, "backport", "token")
+
+	templates, err := service.ParseTemplates(service.DefaultBranchTemplate, service.DefaultTitleTemplate, service.DefaultBodyTemplate,
+		append(service.DefaultTrailers, "Backport-Branch: {{.Branch}}"))
+	require.NoError(t, err)
+	opts := service.BackportOptions{Templates: templates}
+	_, err = s.ApplyCommitsToRepo("org", "repo", 1, "1.x", []string{fix}, opts)
+	require.NoError(t, err)
+
+	message := git(t, bare, "log", "-1", "--format=%B", "backport-PR-1-to-1.x")
+	assert.Equal(t, "fix a bug\n\n(cherry picked from commit "+fix+")\nBackport-Of: org/repo#1\nBackport-Branch: 1.x\n\n", message)
+
+	// the branch is read with the credentials of the scm when the repository is private
+	server.RequireCredentials("backport", "token")
+
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(os.Stderr)
+
+	backports, err := s.ListBackportsToBranch("org", "repo", "1.x")
+	require.NoError(t, err)
+	assert.Empty(t, backports)
+	assert.Contains(t, logs.String(), "backport:xxxxx@")
+	assert.NotContains(t, logs.String(), "token")
+
+	// once the backport PR is merged the release branch records what was backported
+	git(t, bare, "update-ref", "refs/heads/1.x", "backport-PR-1-to-1.x")
+	backport := strings.TrimSpace(git(t, bare, "rev-parse", "1.x"))
+
+	backports, err = s.ListBackportsToBranch("org", "repo", "1.x")
+	require.NoError(t, err)
+	assert.Equal(t, []service.Backport{{PR: "org/repo#1", Commits: []string{backport}}}, backports)
+}
+
+func TestGiteaCopyMetadata(t *testing.T) {
+	type test struct {
+		name              string
+		opts              service.BackportOptions
+		expectedTitle     string
+		expectedBody      string
+		expectedLabels    []string
+		expectedAssignees []string
+		expectedMilestone int64
+	}
+
+	tests := []test{
+		{
+			name:          "nothing copied",
+			opts:          service.BackportOptions{},
+			expectedTitle: "Backporting PR-1 to 1.x",
+			expectedBody:  "Backport from {{server}}/org/repo/pulls/1",
+		},
+		{
+			name:          "only the title and body",
+			opts:          service.BackportOptions{Copy: []string{service.CopyTitle, service.CopyBody}},
+			expectedTitle: "[1.x] Fix a bug",
+			expectedBody:  "Backport from {{server}}/org/repo/pulls/1\n\nFixes the bug.",
+		},
+		{
+			name:              "everything copied",
+			opts:              service.BackportOptions{Copy: service.DefaultCopy},
+			expectedTitle:     "[1.x] Fix a bug",
+			expectedBody:      "Backport from {{server}}/org/repo/pulls/1\n\nFixes the bug.",
+			expectedLabels:    []string{"kind/bug"},
+			expectedAssignees: []string{"alice", "bob"},
+			expectedMilestone: 3,
+		},
+		{
+			name: "repository copies its own fields",
+			opts: service.BackportOptions{
+				Copy:     service.DefaultCopy,
+				RepoCopy: map[string][]string{"org/repo": {service.CopyTitle, service.CopyLabels}},
+			},
+			expectedTitle:  "[1.x] Fix a bug",
+			expectedBody:   "Backport from {{server}}/org/repo/pulls/1",
+			expectedLabels: []string{"kind/bug"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			server, err := giteatest.NewServer(filepath.Join(root, "server"))
+			require.NoError(t, err)
+			defer server.Close()
+
+			bare, err := server.CreateRepo("org", "repo")
+			require.NoError(t, err)
+
+			work := filepath.Join(root, "work")
+			git(t, root, "clone", bare, work)
+			writeFile(t, work, "README.md", "hello\n")
+			git(t, work, "add", ".")
+			git(t, work, "commit", "-m", "initial commit")
+			git(t, work, "branch", "1.x")
+			writeFile(t, work, "fix.txt", "fixed\n")
+			git(t, work, "add", ".")
+			git(t, work, "commit", "-m", "fix a bug")
+			fix := head(t, work)
+			git(t, work, "push", "origin", "main", "1.x")
+
+			server.AddPullRequest("org", "repo", giteatest.PullRequest{
+				Number:    1,
+				Title:     "Fix a bug",
+				Body:      "Fixes the bug.",
+				Head:      "fix",
+				Base:      "main",
+				Merged:    true,
+				Labels:    []string{"Backport to 1.x", "kind/bug"},
+				Commits:   []string{fix},
+				Assignees: []string{"alice", "bob"},
+				Milestone: 3,
+			})
+
+			s := service.NewScm(service.Server{Driver: service.DriverGitea, URL: server.URL}, "backport", "token")
+
+			_, err = s.ApplyCommitsToRepo("org", "repo", 1, "1.x", []string{fix}, test.opts)
+			require.NoError(t, err)
+
+			prs := server.PullRequests("org", "repo")
+			require.Len(t, prs, 2)
+			assert.Equal(t, test.expectedTitle, prs[1].Title)
+			assert.Equal(t, strings.ReplaceAll(test.expectedBody, "{{server}}", server.URL), prs[1].Body)
+			assert.Equal(t, test.expectedLabels, prs[1].Labels)
+			assert.Equal(t, test.expectedAssignees, prs[1].Assignees)
+			assert.Equal(t, test.expectedMilestone, prs[1].Milestone)
+		})
+	}
+}
+
+func TestGiteaMirrors(t *testing.T) {
+	root := t.TempDir()
+	server, err := giteatest.NewServer(filepath.Join(root, "server"))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// each repository has a fix on main to backport to its release branch
+	var fixes []string
+	bares := map[string]string{}
+	for _, name := range []string{"one", "two"} {
+		bare, err := server.CreateRepo("org", name)
+		require.NoError(t, err)
+		bares[name] = bare
+
+		work := filepath.Join(root, name)
+		git(t, root, "clone", bare, work)
+		writeFile(t, work, "README.md", "hello\n")
+		git(t, work, "add", ".")
+		git(t, work, "commit", "-m", "initial commit")
+		git(t, work, "branch", "1.x")
+		writeFile(t, work, "fix.txt", "fixed\n")
+		git(t, work, "add", ".")
+		git(t, work, "commit", "-m", "fix a bug")
+		fixes = append(fixes, head(t, work))
+		git(t, work, "push", "origin", "main", "1.x")
+
+		server.AddPullRequest("org", name, giteatest.PullRequest{
+			Number:  1,
+			Title:   "Fix a bug",
+			Head:    "fix",
+			Base:    "main",
+			Merged:  true,
+			Commits: []string{head(t, work)},
+		})
+	}
+
+	// the mirrors fetch with the credentials of the scm when the repositories are private
+	server.RequireCredentials("backport", "token")
+
+	s := service.NewScm(service.Server{Driver: service.DriverGitea, URL: server.URL}, "backport", "token")
+	cache := filepath.Join(root, "cache")
+	opts := service.BackportOptions{Mirrors: service.NewMirrors(cache, time.Hour, 1)}
+	mirror := func(name string) string {
+		return filepath.Join(cache, strings.TrimPrefix(server.URL, "http://"), "org", name+".git")
+	}
+
+	_, err = s.ApplyCommitsToRepo("org", "one", 1, "1.x", fixes[:1], opts)
+	require.NoError(t, err)
+
+	// the worktree and its branch are removed once the backport has been pushed
+	assert.Equal(t, "fix a bug\n", git(t, bares["one"], "log", "--format=%s", "1.x..backport-PR-1-to-1.x"))
+	assert.Len(t, strings.Split(strings.TrimSpace(git(t, mirror("one"), "worktree", "list")), "\n"), 1)
+	assert.Empty(t, git(t, mirror("one"), "branch"))
+
+	// the next backport fetches into the existing mirror
+	result, err := s.ApplyCommitsToRepo("org", "one", 1, "1.x", fixes[:1], opts)
+	require.NoError(t, err)
+	assert.Contains(t, result.Log, "fetch --prune origin")
+	assert.True(t, result.Updated)
+	assert.NotContains(t, git(t, mirror("one"), "config", "--list"), "token")
+
+	// only the most recently used mirror is kept
+	_, err = s.ApplyCommitsToRepo("org", "two", 1, "1.x", fixes[1:], opts)
+	require.NoError(t, err)
+	assert.DirExists(t, mirror("two"))
+	assert.NoDirExists(t, mirror("one"))
+}
+
+func TestGiteaMergeMethods(t *testing.T) {
+	type test struct {
+		name string
+		// merge merges the fix branch into main, returning the merge commit and the
+		// commits expected to be cherry-picked.
+		merge    func(t *testing.T, work string, fix []string) (string, []string)
+		expected string
+	}
+
+	tests := []test{
+		{
+			name: "merge commit",
+			merge: func(t *testing.T, work string, fix []string) (string, []string) {
+				git(t, work, "merge", "--no-ff", "-m", "Merge fix", "fix")
+				sha := head(t, work)
+				return sha, []string{"-m 1 " + sha}
+			},
+			expected: "Merge fix\n",
+		},
+		{
+			name: "squash",
+			merge: func(t *testing.T, work string, fix []string) (string, []string) {
+				git(t, work, "merge", "--squash", "fix")
+				git(t, work, "commit", "-m", "Fix a bug (#1)")
+				sha := head(t, work)
+				return sha, []string{sha}
+			},
+			expected: "Fix a bug (#1)\n",
+		},
+		{
+			name: "rebase",
+			merge: func(t *testing.T, work string, fix []string) (string, []string) {
+				writeFile(t, work, "other.txt", "other\n")
+				git(t, work, "add", ".")
+				git(t, work, "commit", "-m", "another change")
+				git(t, work, "cherry-pick", fix[0], fix[1])
+				return head(t, work), strings.Fields(git(t, work, "rev-list", "--reverse", "HEAD~2..HEAD"))
+			},
+			expected: "fix b\nfix a\n",
+		},
+		{
+			name: "fast forward",
+			merge: func(t *testing.T, work string, fix []string) (string, []string) {
+				git(t, work, "merge", "--ff-only", "fix")
+				return head(t, work), fix
+			},
+			expected: "fix b\nfix a\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			server, err := giteatest.NewServer(filepath.Join(root, "server"))
+			require.NoError(t, err)
+			defer server.Close()
+
+			bare, err := server.CreateRepo("org", "repo")
+			require.NoError(t, err)
+
+			work := filepath.Join(root, "work")
+			git(t, root, "clone", bare, work)
+			writeFile(t, work, "README.md", "hello\n")
+			git(t, work, "add", ".")
+			git(t, work, "commit", "-m", "initial commit")
+			git(t, work, "branch", "1.x")
+			writeFile(t, work, "main.txt", "main\n")
+			git(t, work, "add", ".")
+			git(t, work, "commit", "-m", "change main")
+
+			git(t, work, "checkout", "-b", "fix")
+			writeFile(t, work, "a.txt", "a\n")
+			git(t, work, "add", ".")
+			git(t, work, "commit", "-m", "fix a")
+			writeFile(t, work, "b.txt", "b\n")
+			git(t, work, "add", ".")
+			git(t, work, "commit", "-m", "fix b")
+			fix := strings.Fields(git(t, work, "rev-list", "--reverse", "main..fix"))
+
+			// the PR's commits are only kept by the PR's ref
+			git(t, work, "checkout", "main")
+			mergeSha, picked := test.merge(t, work, fix)
+			git(t, work, "push", "origin", "main", "1.x", "fix:refs/pull/1/head")
+
+			server.AddPullRequest("org", "repo", giteatest.PullRequest{
+				Number:   1,
+				Title:    "Fix a bug",
+				Head:     "fix",
+				Base:     "main",
+				Merged:   true,
+				Commits:  fix,
+				MergeSha: mergeSha,
+			})
+
+			s := service.NewScm(service.Server{Driver: service.DriverGitea, URL: server.URL}, "backport", "token")
+			result, err := s.ApplyCommitsToRepo("org", "repo", 1, "1.x", fix, service.BackportOptions{})
+			require.NoError(t, err)
+
+			log := git(t, bare, "log", "--format=%s", "1.x..backport-PR-1-to-1.x")
+			assert.Equal(t, test.expected, log)
+
+			for _, commit := range picked {
+				assert.Contains(t, result.Log, "git cherry-pick -x "+commit+"\n")
+			}
+		})
+	}
+}
+
+func head(t *testing.T, dir string) string {
+	t.Helper()
+	return strings.TrimSpace(git(t, dir, "rev-parse", "HEAD"))
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return string(out)
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+}
+
+func TestGiteaStatusComment(t *testing.T) {
+	root := t.TempDir()
+	server, err := giteatest.NewServer(filepath.Join(root, "server"))
+	require.NoError(t, err)
+	defer server.Close()
+
+	_, err = server.CreateRepo("org", "repo")
+	require.NoError(t, err)
+	server.AddPullRequest("org", "repo", giteatest.PullRequest{Number: 1, Title: "Fix a bug", Head: "fix", Base: "main"})
+
+	// the username of a token is often a placeholder rather than the user's login
+	s := service.NewScm(service.Server{Driver: service.DriverGitea, URL: server.URL}, "oauth2", "token")
+
+	id, _, err := s.FindCommentOnPr("org", "repo", 1, "<!-- status -->")
+	require.NoError(t, err)
+	assert.Zero(t, id)
+
+	// someone else's comment quoting the status is not ours to edit
+	server.AddComment("org", "repo", 1, "octocat", "> queued\n> <!-- status -->")
+	require.NoError(t, s.AddCommentToPr("org", "repo", 1, "thanks"))
+	require.NoError(t, s.AddCommentToPr("org", "repo", 1, "queued\n<!-- status -->"))
+
+	id, body, err := s.FindCommentOnPr("org", "repo", 1, "<!-- status -->")
+	require.NoError(t, err)
+	assert.NotZero(t, id)
+	assert.Equal(t, "queued\n<!-- status -->", body)
+
+	require.NoError(t, s.EditCommentOnPr("org", "repo", 1, id, "done\n<!-- status -->"))
+	assert.Equal(t, []string{"> queued\n> <!-- status -->", "thanks", "done\n<!-- status -->"}, server.Comments("org", "repo", 1))
+}
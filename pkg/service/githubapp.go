@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/transport"
+	"github.com/sirupsen/logrus"
+)
+
+// installationTokenUsername is the username git expects with an installation token.
+const installationTokenUsername = "x-access-token"
+
+// tokenExpiryMargin renews cached tokens early so that a token never expires part
+// way through a backport.
+const tokenExpiryMargin = 5 * time.Minute
+
+// GitHubApp authenticates with github as a github app, exchanging a JWT signed with
+// the app's private key for a token for the installation that sent each webhook.
+type GitHubApp struct {
+	// url is the server the app is registered on, the app's JWT is only ever sent
+	// there rather than to a server named by a webhook.
+	url string
+	id  int64
+	key *rsa.PrivateKey
+
+	mu         sync.Mutex
+	tokens     map[string]*scm.InstallationToken
+	identities map[string]identity
+}
+
+// identity is the name and email of the bot user that authors the app's commits.
+type identity struct {
+	name  string
+	email string
+}
+
+// NewGitHubAppFromEnv creates a GitHubApp from $GITHUB_APP_ID and the private key in
+// $GITHUB_APP_PRIVATE_KEY_PATH, returning nil if no app has been configured. The app
+// is registered on $GITHUB_APP_URL, or else the github server given by $GIT_SERVER,
+// or else github.com.
+func NewGitHubAppFromEnv() (*GitHubApp, error) {
+	appID := os.Getenv("GITHUB_APP_ID")
+	if appID == "" {
+		return nil, nil
+	}
+
+	id, err := strconv.ParseInt(appID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GITHUB_APP_ID %s: %w", appID, err)
+	}
+
+	key, err := os.ReadFile(os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"))
+	if err != nil {
+		return nil, err
+	}
+
+	u := os.Getenv("GITHUB_APP_URL")
+	if kind := os.Getenv("GIT_KIND"); u == "" && (kind == "" || kind == DriverGitHub) {
+		u = os.Getenv("GIT_SERVER")
+	}
+	if u == "" {
+		u = DefaultURL(DriverGitHub)
+	}
+
+	return NewGitHubApp(u, id, key)
+}
+
+// NewGitHubApp creates a GitHubApp registered on the server at url from its id and
+// PEM encoded private key.
+func NewGitHubApp(url string, id int64, privateKey []byte) (*GitHubApp, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, errors.New("unable to decode the github app private key")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		key, ok = parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("the github app private key is not an RSA key")
+		}
+	}
+
+	return &GitHubApp{
+		url:        strings.TrimSuffix(url, "/"),
+		id:         id,
+		key:        key,
+		tokens:     map[string]*scm.InstallationToken{},
+		identities: map[string]identity{},
+	}, nil
+}
+
+// NewGitHubAppScm creates a Scm that acts as the app's installation on server, so
+// that backport PRs, comments and commits are authored by the app's bot user.
+func NewGitHubAppScm(server Server, app *GitHubApp) (Scm, error) {
+	token, err := app.Token(server)
+	if err != nil {
+		return nil, err
+	}
+
+	bot, err := app.identity(server, token)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewClient(server, token)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scmImpl{
+		client:   c,
+		server:   server,
+		username: installationTokenUsername,
+		token:    token,
+		name:     bot.name,
+		email:    bot.email,
+		// an installation cannot look up its own user
+		login: bot.name,
+	}
+	s.intents = NewIntentStore(s)
+	return s, nil
+}
+
+// Token returns a token for the installation that sent the webhook, the token is
+// cached until shortly before it expires.
+func (a *GitHubApp) Token(server Server) (string, error) {
+	if server.Installation == 0 {
+		return "", errors.New("the webhook was not sent by a github app installation")
+	}
+	err := a.check(server)
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%d", server.URL, server.Installation)
+	token, ok := a.tokens[key]
+	if ok && token.ExpiresAt != nil && time.Until(*token.ExpiresAt) > tokenExpiryMargin {
+		return token.Token, nil
+	}
+
+	client, err := a.client(server)
+	if err != nil {
+		return "", err
+	}
+
+	logrus.Infof("creating a token for installation %d", server.Installation)
+	token, _, err = client.Apps.CreateInstallationToken(context.Background(), server.Installation)
+	if err != nil {
+		return "", err
+	}
+
+	a.tokens[key] = token
+	return token.Token, nil
+}
+
+// identity looks up the bot user of the app, e.g. backport[bot], whose noreply email
+// links commits to the bot.
+func (a *GitHubApp) identity(server Server, token string) (identity, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if bot, ok := a.identities[server.URL]; ok {
+		return bot, nil
+	}
+
+	client, err := a.client(server)
+	if err != nil {
+		return identity{}, err
+	}
+
+	resp, err := client.Do(context.Background(), &scm.Request{Method: "GET", Path: "app"})
+	if err != nil {
+		return identity{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.Status != http.StatusOK {
+		return identity{}, fmt.Errorf("unable to find github app %d: %d", a.id, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return identity{}, err
+	}
+
+	var app struct {
+		Slug string `json:"slug"`
+	}
+	err = json.Unmarshal(body, &app)
+	if err != nil {
+		return identity{}, err
+	}
+
+	c, err := NewClient(server, token)
+	if err != nil {
+		return identity{}, err
+	}
+
+	login := app.Slug + "[bot]"
+	user, _, err := c.Users.FindLogin(context.Background(), login)
+	if err != nil {
+		return identity{}, err
+	}
+
+	bot := identity{name: login, email: fmt.Sprintf("%d+%s@users.noreply.%s", user.ID, login, hostname(server.URL))}
+	a.identities[server.URL] = bot
+	return bot, nil
+}
+
+// check refuses a server other than the one the app is registered on, which may
+// have been named by a forged webhook.
+func (a *GitHubApp) check(server Server) error {
+	if server.Driver != DriverGitHub || strings.TrimSuffix(server.URL, "/") != a.url {
+		return fmt.Errorf("the github app is registered on %s, not %s", a.url, server.URL)
+	}
+	return nil
+}
+
+// client returns a client authenticated as the app itself.
+func (a *GitHubApp) client(server Server) (*scm.Client, error) {
+	err := a.check(server)
+	if err != nil {
+		return nil, err
+	}
+
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(server, "")
+	if err != nil {
+		return nil, err
+	}
+	client.Client = &http.Client{Transport: &transport.BearerToken{Token: jwt}}
+	return client, nil
+}
+
+// jwt returns a JWT identifying the app, signed with its private key.
+func (a *GitHubApp) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	// backdate the token to allow for clock drift, github rejects tokens that are
+	// valid for more than 10 minutes.
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.id, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
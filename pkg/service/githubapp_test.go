@@ -0,0 +1,110 @@
+package service_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// the first token is about to expire so must be renewed, the second is cached
+	expiries := []time.Duration{time.Minute, time.Hour}
+	var created []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		verifyJWT(t, &key.PublicKey, r)
+
+		token := fmt.Sprintf("token-%d", len(created)+1)
+		expiresAt := time.Now().Add(expiries[len(created)])
+		created = append(created, token)
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": expiresAt})
+	})
+	mux.HandleFunc("/api/v3/app", func(w http.ResponseWriter, r *http.Request) {
+		verifyJWT(t, &key.PublicKey, r)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "slug": "backport"})
+	})
+	mux.HandleFunc("/api/v3/users/backport[bot]", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99, "login": "backport[bot]"})
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	app, err := service.NewGitHubApp(ts.URL, 1, privateKey)
+	require.NoError(t, err)
+
+	server := service.Server{Driver: service.DriverGitHub, URL: ts.URL, Installation: 42}
+
+	token, err := app.Token(server)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	token, err = app.Token(server)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	token, err = app.Token(server)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+	assert.Len(t, created, 2)
+
+	_, err = service.NewGitHubAppScm(server, app)
+	require.NoError(t, err)
+
+	_, err = app.Token(service.Server{Driver: service.DriverGitHub, URL: ts.URL})
+	assert.Error(t, err)
+
+	// the app's JWT is not sent to a server named by a webhook
+	forged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	}))
+	defer forged.Close()
+
+	_, err = app.Token(service.Server{Driver: service.DriverGitHub, URL: forged.URL, Installation: 42})
+	assert.EqualError(t, err, fmt.Sprintf("the github app is registered on %s, not %s", ts.URL, forged.URL))
+
+	_, err = service.NewGitHubAppScm(service.Server{Driver: service.DriverGitHub, URL: forged.URL, Installation: 42}, app)
+	assert.Error(t, err)
+}
+
+func verifyJWT(t *testing.T, key *rsa.PublicKey, r *http.Request) {
+	t.Helper()
+
+	parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+	require.Len(t, parts, 3)
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature))
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]interface{}
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "1", claims["iss"])
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jenkins-x/go-scm/scm"
+)
+
+// IntentStore records the branches that a PR has been asked to be backported to.
+type IntentStore interface {
+	Branches(owner string, repo string, pr int, prefix string) ([]string, error)
+	Add(owner string, repo string, pr int, branch string, prefix string) error
+	Remove(owner string, repo string, pr int, branch string, prefix string) error
+}
+
+// NewIntentStore returns the IntentStore used for server, providers without native
+// PR labels record the intent in comments instead.
+func NewIntentStore(s *scmImpl) IntentStore {
+	if s.server.Driver == DriverBitbucketServer {
+		return &commentIntentStore{client: s.client}
+	}
+	return &labelIntentStore{scm: s}
+}
+
+// labelIntentStore stores each intent as a "<prefix><branch>" label on the PR, by
+// default "Backport to <branch>".
+type labelIntentStore struct {
+	scm *scmImpl
+}
+
+func (l *labelIntentStore) Branches(owner string, repo string, pr int, prefix string) ([]string, error) {
+	pullRequest, _, err := l.scm.client.PullRequests.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr)
+	if err != nil {
+		return nil, err
+	}
+
+	return branchesFromLabels(pullRequest.Labels, prefix), nil
+}
+
+func (l *labelIntentStore) Add(owner string, repo string, pr int, branch string, prefix string) error {
+	return l.scm.AddLabelToPr(owner, repo, pr, prefix+branch)
+}
+
+func (l *labelIntentStore) Remove(owner string, repo string, pr int, branch string, prefix string) error {
+	return l.scm.RemoveLabelFromPr(owner, repo, pr, prefix+branch)
+}
+
+// commentIntentStore stores each intent as a label comment on the PR, using the
+// label emulation go-scm provides for providers without labels.
+type commentIntentStore struct {
+	client *scm.Client
+}
+
+func (c *commentIntentStore) Branches(owner string, repo string, pr int, prefix string) ([]string, error) {
+	labels, _, err := c.client.PullRequests.ListLabels(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, &scm.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return branchesFromLabels(labels, prefix), nil
+}
+
+func (c *commentIntentStore) Add(owner string, repo string, pr int, branch string, prefix string) error {
+	_, err := c.client.PullRequests.AddLabel(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, prefix+branch)
+	return err
+}
+
+func (c *commentIntentStore) Remove(owner string, repo string, pr int, branch string, prefix string) error {
+	_, err := c.client.PullRequests.DeleteLabel(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, prefix+branch)
+	return err
+}
+
+func branchesFromLabels(labels []*scm.Label, prefix string) []string {
+	var branches []string
+	for _, label := range labels {
+		if strings.HasPrefix(label.Name, prefix) {
+			branches = append(branches, strings.TrimPrefix(label.Name, prefix))
+		}
+	}
+	return branches
+}
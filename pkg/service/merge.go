@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+)
+
+// pick is a commit to cherry-pick onto the backport branch.
+type pick struct {
+	Commit string
+	// Mainline picks a merge commit relative to its first parent, i.e. -m 1.
+	Mainline bool
+}
+
+// remaining returns the commits of the picks.
+func remaining(picks []pick) []string {
+	var commits []string
+	for _, p := range picks {
+		commits = append(commits, p.Commit)
+	}
+	return commits
+}
+
+// commitsToPick works out how the source PR was merged, and so which commits on the
+// base branch need to be cherry-picked for the backport to match what was merged:
+//   - a merge commit is picked relative to the base branch
+//   - the commits of a fast-forward merge are picked as they are
+//   - the rebased commits of a rebase merge are picked
+//   - the commit of a squash merge is picked
+//
+// The PR's own commits are picked if the merge commit cannot be found.
+func (s *scmImpl) commitsToPick(dir string, owner string, repo string, source *scm.PullRequest, commits []string) []pick {
+	originals := make([]pick, 0, len(commits))
+	for _, commit := range commits {
+		originals = append(originals, pick{Commit: commit})
+	}
+
+	mergeSha := s.mergeSha(owner, repo, source)
+	if mergeSha == "" || len(commits) == 0 {
+		return originals
+	}
+
+	out, err := executeGit(dir, "rev-list", "--parents", "-n", "1", mergeSha)
+	if err != nil {
+		logrus.Warnf("unable to find merge commit %s, picking the PR's commits: %v", mergeSha, err)
+		return originals
+	}
+
+	if parents := strings.Fields(out); len(parents) > 2 {
+		logrus.Infof("PR-%d was merged with merge commit %s", source.Number, mergeSha)
+		return []pick{{Commit: mergeSha, Mainline: true}}
+	}
+
+	// the PR's commits may only be reachable from the PR's ref once it has been
+	// squashed or rebased.
+	if source.Ref != "" {
+		_, err = executeGit(dir, "fetch", "origin", source.Ref)
+		if err != nil {
+			logrus.Warnf("unable to fetch %s: %v", source.Ref, err)
+		}
+	}
+
+	_, err = executeGit(dir, "merge-base", "--is-ancestor", commits[len(commits)-1], mergeSha)
+	if err == nil {
+		logrus.Infof("PR-%d was fast-forwarded", source.Number)
+		return originals
+	}
+
+	if rebased := rebasedCommits(dir, mergeSha, commits); rebased != nil {
+		logrus.Infof("PR-%d was rebased as %s", source.Number, remaining(rebased))
+		return rebased
+	}
+
+	logrus.Infof("PR-%d was squashed as %s", source.Number, mergeSha)
+	return []pick{{Commit: mergeSha}}
+}
+
+// rebasedCommits returns the commits ending at mergeSha that make the same changes as
+// the PR's commits, or nil if the PR was not rebased.
+func rebasedCommits(dir string, mergeSha string, commits []string) []pick {
+	if len(commits) == 1 {
+		// a single commit that was rebased or squashed is picked the same way
+		return nil
+	}
+
+	out, err := executeGit(dir, "rev-list", "--first-parent", "--reverse", fmt.Sprintf("--max-count=%d", len(commits)), mergeSha)
+	if err != nil {
+		return nil
+	}
+
+	candidates := strings.Fields(out)
+	if len(candidates) != len(commits) {
+		return nil
+	}
+
+	var rebased []pick
+	for i, candidate := range candidates {
+		original, err := patchID(dir, commits[i])
+		if err != nil {
+			return nil
+		}
+
+		id, err := patchID(dir, candidate)
+		if err != nil || id != original {
+			return nil
+		}
+		rebased = append(rebased, pick{Commit: candidate})
+	}
+	return rebased
+}
+
+// patchID identifies the changes made by a commit, ignoring where it was applied.
+func patchID(dir string, commit string) (string, error) {
+	diff, err := exec.Command("git", "-C", dir, "diff-tree", "-p", commit).Output()
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("git", "-C", dir, "patch-id", "--stable")
+	cmd.Stdin = strings.NewReader(string(diff))
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s makes no changes", commit)
+	}
+	return fields[0], nil
+}
+
+// mergeSha returns the commit the PR was merged as, or "" if it is not known.
+func (s *scmImpl) mergeSha(owner string, repo string, source *scm.PullRequest) string {
+	if !source.Merged {
+		return ""
+	}
+
+	// the gitlab driver does not return the merge commit of a merge request
+	if s.server.Driver == DriverGitLab && source.MergeSha == "" {
+		sha, err := s.findGitLabMergeSha(owner, repo, source.Number)
+		if err != nil {
+			logrus.Warnf("unable to find the merge commit of %s/%s!%d: %v", owner, repo, source.Number, err)
+		}
+		return sha
+	}
+
+	return source.MergeSha
+}
+
+// findGitLabMergeSha returns the merge commit of a merge request, or the squashed
+// commit when it was squashed and fast-forwarded.
+func (s *scmImpl) findGitLabMergeSha(owner string, repo string, number int) (string, error) {
+	path := fmt.Sprintf("api/v4/projects/%s/merge_requests/%d", url.PathEscape(owner+"/"+repo), number)
+	resp, err := s.client.Do(context.Background(), &scm.Request{Method: "GET", Path: path})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Status != http.StatusOK {
+		return "", fmt.Errorf("unable to get %s: %d %s", path, resp.Status, body)
+	}
+
+	var mr struct {
+		MergeCommitSha  string `json:"merge_commit_sha"`
+		SquashCommitSha string `json:"squash_commit_sha"`
+	}
+	err = json.Unmarshal(body, &mr)
+	if err != nil {
+		return "", err
+	}
+
+	if mr.MergeCommitSha != "" {
+		return mr.MergeCommitSha, nil
+	}
+	return mr.SquashCommitSha, nil
+}
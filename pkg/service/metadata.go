@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+)
+
+// The fields of the source PR that can be copied to its backport PRs, the title and
+// body are rendered by the templates.
+const (
+	CopyTitle     = "title"
+	CopyBody      = "body"
+	CopyLabels    = "labels"
+	CopyAssignees = "assignees"
+	CopyMilestone = "milestone"
+	CopyReviewers = "reviewers"
+)
+
+// DefaultCopy are the fields copied to a backport PR unless $BACKPORT_COPY is set.
+var DefaultCopy = []string{CopyTitle, CopyBody, CopyLabels, CopyAssignees, CopyMilestone, CopyReviewers}
+
+// copyFromEnv reads the fields copied to the backport PRs of each repository from
+// $BACKPORT_COPY, and the repositories that copy other fields from
+// $BACKPORT_COPY_REPOS as owner/repo=fields separated by semicolons.
+func copyFromEnv() ([]string, map[string][]string, error) {
+	fields := DefaultCopy
+	if s, ok := os.LookupEnv("BACKPORT_COPY"); ok {
+		var err error
+		fields, err = parseCopy(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid BACKPORT_COPY %s: %w", s, err)
+		}
+	}
+
+	repos := map[string][]string{}
+	for _, entry := range strings.Split(os.Getenv("BACKPORT_COPY_REPOS"), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		repo, s, ok := strings.Cut(entry, "=")
+		if !ok || strings.Count(repo, "/") == 0 {
+			return nil, nil, fmt.Errorf("invalid BACKPORT_COPY_REPOS %s: expected owner/repo=fields", entry)
+		}
+		repoFields, err := parseCopy(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid BACKPORT_COPY_REPOS %s: %w", entry, err)
+		}
+		repos[strings.TrimSpace(repo)] = repoFields
+	}
+
+	return fields, repos, nil
+}
+
+// parseCopy parses the comma separated fields, an empty value copies none.
+func parseCopy(s string) ([]string, error) {
+	fields := []string{}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		fields = append(fields, field)
+	}
+	return fields, validateCopy(fields)
+}
+
+// validateCopy checks that each of the fields can be copied.
+func validateCopy(fields []string) error {
+	for _, field := range fields {
+		if !contains(DefaultCopy, field) {
+			return fmt.Errorf("unknown field %s, expected one of %s", field, strings.Join(DefaultCopy, ", "))
+		}
+	}
+	return nil
+}
+
+// CopyFor returns the fields of the source PR that are copied to the backport PRs
+// of owner/repo.
+func (o BackportOptions) CopyFor(owner string, repo string) []string {
+	if fields, ok := o.RepoCopy[owner+"/"+repo]; ok {
+		return fields
+	}
+	return o.Copy
+}
+
+// copyMetadata copies the labels, assignees, milestone and reviewers of source to
+// the backport PR, as far as fields asks. They are not essential to the backport, so
+// a failure to copy one is logged rather than returned.
+func (s *scmImpl) copyMetadata(owner string, repo string, source *scm.PullRequest, number int, fields []string, prefix string) {
+	fullName := fmt.Sprintf("%s/%s", owner, repo)
+	ctx := context.Background()
+
+	if contains(fields, CopyLabels) {
+		for _, label := range source.Labels {
+			// the backport labels belong to the source PR alone
+			if strings.HasPrefix(label.Name, prefix) || label.Name == ConflictLabel {
+				continue
+			}
+			err := s.AddLabelToPr(owner, repo, number, label.Name)
+			if err != nil {
+				logrus.Warnf("unable to copy label %s to %s#%d: %v", label.Name, fullName, number, err)
+			}
+		}
+	}
+
+	if contains(fields, CopyAssignees) && len(source.Assignees) > 0 {
+		_, err := s.client.PullRequests.AssignIssue(ctx, fullName, number, logins(source.Assignees))
+		if err != nil {
+			logrus.Warnf("unable to copy the assignees to %s#%d: %v", fullName, number, err)
+		}
+	}
+
+	if contains(fields, CopyReviewers) && len(source.Reviewers) > 0 {
+		_, err := s.client.PullRequests.RequestReview(ctx, fullName, number, logins(source.Reviewers))
+		if err != nil {
+			logrus.Warnf("unable to copy the reviewers to %s#%d: %v", fullName, number, err)
+		}
+	}
+
+	if contains(fields, CopyMilestone) {
+		milestone, err := s.findMilestone(owner, repo, source.Number)
+		if err == nil && milestone != 0 {
+			_, err = s.client.PullRequests.SetMilestone(ctx, fullName, number, milestone)
+		}
+		if err != nil {
+			logrus.Warnf("unable to copy the milestone to %s#%d: %v", fullName, number, err)
+		}
+	}
+}
+
+// findMilestone returns the milestone of a PR as the drivers set it, the number on
+// github and the id elsewhere, or 0 if it has none. None of the drivers return the
+// milestone of a PR and bitbucket server has no milestones.
+func (s *scmImpl) findMilestone(owner string, repo string, pr int) (int, error) {
+	var path string
+	switch s.server.Driver {
+	case DriverGitHub:
+		path = fmt.Sprintf("repos/%s/%s/issues/%d", owner, repo, pr)
+	case DriverGitea:
+		path = fmt.Sprintf("api/v1/repos/%s/%s/pulls/%d", owner, repo, pr)
+	case DriverGitLab:
+		path = fmt.Sprintf("api/v4/projects/%s/merge_requests/%d", url.PathEscape(owner+"/"+repo), pr)
+	default:
+		return 0, nil
+	}
+
+	resp, err := s.client.Do(context.Background(), &scm.Request{Method: "GET", Path: path})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.Status != http.StatusOK {
+		return 0, fmt.Errorf("unable to get %s: %d %s", path, resp.Status, body)
+	}
+
+	var issue struct {
+		Milestone *struct {
+			ID     int `json:"id"`
+			Number int `json:"number"`
+		} `json:"milestone"`
+	}
+	err = json.Unmarshal(body, &issue)
+	if err != nil || issue.Milestone == nil {
+		return 0, err
+	}
+
+	if s.server.Driver == DriverGitHub {
+		return issue.Milestone.Number, nil
+	}
+	return issue.Milestone.ID, nil
+}
+
+func logins(users []scm.User) []string {
+	var l []string
+	for _, user := range users {
+		l = append(l, user.Login)
+	}
+	return l
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyFromEnv(t *testing.T) {
+	type test struct {
+		name          string
+		copy          string
+		repos         string
+		expectedCopy  map[string][]string
+		expectedError string
+	}
+
+	tests := []test{
+		{
+			name: "defaults to everything",
+			expectedCopy: map[string][]string{
+				"org/repo": service.DefaultCopy,
+			},
+		},
+		{
+			name:  "repositories override the default",
+			copy:  "milestone, labels",
+			repos: "org/docs=assignees;org/none=",
+			expectedCopy: map[string][]string{
+				"org/repo": {"milestone", "labels"},
+				"org/docs": {"assignees"},
+				"org/none": {},
+			},
+		},
+		{
+			name:  "title and body",
+			copy:  "title,body,labels",
+			repos: "org/docs=labels",
+			expectedCopy: map[string][]string{
+				"org/repo": {"title", "body", "labels"},
+				"org/docs": {"labels"},
+			},
+		},
+		{
+			name:          "unknown field",
+			copy:          "labels,colour",
+			expectedError: "invalid BACKPORT_COPY labels,colour: unknown field colour, expected one of title, body, labels, assignees, milestone, reviewers",
+		},
+		{
+			name:          "missing repository",
+			repos:         "labels",
+			expectedError: "invalid BACKPORT_COPY_REPOS labels: expected owner/repo=fields",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.copy != "" {
+				t.Setenv("BACKPORT_COPY", test.copy)
+			}
+			t.Setenv("BACKPORT_COPY_REPOS", test.repos)
+
+			opts, err := service.BackportOptionsFromEnv()
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			for repo, expected := range test.expectedCopy {
+				owner, name, _ := strings.Cut(repo, "/")
+				assert.Equal(t, expected, opts.CopyFor(owner, name), repo)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package service
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMirrorMaxAge is how long a mirror is kept after it was last used, unless
+// $BACKPORT_CACHE_MAX_AGE is set.
+const DefaultMirrorMaxAge = 7 * 24 * time.Hour
+
+// Mirrors caches a bare mirror of each repository that is backported to, so that
+// a backport fetches what has changed and checks out a worktree rather than
+// cloning the whole repository.
+type Mirrors struct {
+	dir string
+	// maxAge evicts the mirrors that have not been used for longer, when not 0.
+	maxAge time.Duration
+	// maxRepos evicts the least recently used mirrors beyond this many, when not 0.
+	maxRepos int
+
+	mu sync.Mutex
+	// locks serialise the changes to each mirror.
+	locks map[string]*sync.Mutex
+	// inUse counts the worktrees of each mirror, which is not evicted while it has any.
+	inUse map[string]int
+}
+
+// NewMirrors creates a cache of mirrors in dir.
+func NewMirrors(dir string, maxAge time.Duration, maxRepos int) *Mirrors {
+	return &Mirrors{
+		dir:      dir,
+		maxAge:   maxAge,
+		maxRepos: maxRepos,
+		locks:    map[string]*sync.Mutex{},
+		inUse:    map[string]int{},
+	}
+}
+
+// MirrorsFromEnv creates the cache of mirrors in $BACKPORT_CACHE_DIR, evicting the
+// mirrors unused for $BACKPORT_CACHE_MAX_AGE and the least recently used beyond
+// $BACKPORT_CACHE_MAX_REPOS.
+func MirrorsFromEnv() (*Mirrors, error) {
+	dir := os.Getenv("BACKPORT_CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "backport-mirrors")
+	}
+
+	maxAge := DefaultMirrorMaxAge
+	if s := os.Getenv("BACKPORT_CACHE_MAX_AGE"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BACKPORT_CACHE_MAX_AGE %s: %w", s, err)
+		}
+		maxAge = d
+	}
+
+	maxRepos := 0
+	if s := os.Getenv("BACKPORT_CACHE_MAX_REPOS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid BACKPORT_CACHE_MAX_REPOS %s", s)
+		}
+		maxRepos = n
+	}
+
+	return NewMirrors(dir, maxAge, maxRepos), nil
+}
+
+// path returns the directory of the mirror of the repository at cloneURL.
+func (m *Mirrors) path(cloneURL string) (string, error) {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(m.dir, u.Host, filepath.FromSlash(strings.TrimSuffix(u.Path, ".git"))+".git"), nil
+}
+
+// acquire marks the mirror as in use and locks it.
+func (m *Mirrors) acquire(mirror string) *sync.Mutex {
+	m.mu.Lock()
+	lock, ok := m.locks[mirror]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[mirror] = lock
+	}
+	m.inUse[mirror]++
+	m.mu.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+// release marks the mirror as no longer in use, then evicts the mirrors that have
+// expired.
+func (m *Mirrors) release(mirror string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inUse[mirror]--
+	if m.inUse[mirror] == 0 {
+		delete(m.inUse, mirror)
+	}
+	m.evict(time.Now())
+}
+
+// worktree fetches the mirror of the repository at cloneURL with the credentials
+// options, creating it if needed, and checks out branch in a worktree at path,
+// returning a func that removes it.
+func (m *Mirrors) worktree(gitter *observableGitter, credentials []string, cloneURL string, branch string, path string) (func(), error) {
+	mirror, err := m.path(cloneURL)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := m.acquire(mirror)
+	defer lock.Unlock()
+
+	err = m.fetch(gitter, credentials, mirror, cloneURL)
+	if err == nil {
+		_, err = gitter.ExecuteGit(mirror, "worktree", "add", "--detach", path, "origin/"+branch)
+	}
+	if err != nil {
+		m.release(mirror)
+		return nil, err
+	}
+
+	return func() {
+		m.remove(mirror, path)
+		m.release(mirror)
+	}, nil
+}
+
+// fetch brings the mirror up to date, creating it if it does not exist.
+func (m *Mirrors) fetch(gitter *observableGitter, credentials []string, mirror string, cloneURL string) error {
+	_, err := os.Stat(mirror)
+	if os.IsNotExist(err) {
+		err = initMirror(mirror, cloneURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = os.Chtimes(mirror, now, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = executeGit(mirror, "worktree", "prune")
+	if err != nil {
+		return err
+	}
+
+	_, err = gitter.ExecuteGit(mirror, append(credentials, "fetch", "--prune", "origin")...)
+	return err
+}
+
+// initMirror creates an empty bare repository that fetches the branches of the
+// repository at cloneURL as origin's, like a clone, so that a worktree can push
+// with a lease. Each worktree has its own config for its credentials and author.
+func initMirror(mirror string, cloneURL string) error {
+	err := os.MkdirAll(filepath.Dir(mirror), 0o755)
+	if err != nil {
+		return err
+	}
+
+	_, err = executeGit(filepath.Dir(mirror), "init", "--bare", filepath.Base(mirror))
+	if err != nil {
+		return err
+	}
+
+	// core.bare only applies to the mirror itself, not its worktrees
+	for _, config := range [][]string{
+		{"remote.origin.url", cloneURL},
+		{"remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*"},
+		{"extensions.worktreeConfig", "true"},
+		{"--unset", "core.bare"},
+		{"--worktree", "core.bare", "true"},
+	} {
+		_, err = executeGit(mirror, append([]string{"config"}, config...)...)
+		if err != nil {
+			_ = os.RemoveAll(mirror)
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the worktree at path along with the branch it checked out.
+func (m *Mirrors) remove(mirror string, path string) {
+	lock := m.acquire(mirror)
+	defer m.release(mirror)
+	defer lock.Unlock()
+
+	branch, err := executeGit(path, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		// the worktree is detached
+		branch = ""
+	}
+
+	_, err = executeGit(mirror, "worktree", "remove", "--force", path)
+	if err != nil {
+		logrus.Warnf("unable to remove worktree %s: %v", path, err)
+	}
+
+	if branch = strings.TrimSpace(branch); branch != "" {
+		_, err = executeGit(mirror, "branch", "-D", branch)
+		if err != nil {
+			logrus.Warnf("unable to delete branch %s: %v", branch, err)
+		}
+	}
+}
+
+// evict removes the mirrors that are not in use and have not been used for longer
+// than maxAge, then the least recently used beyond maxRepos. It must be called
+// with m.mu held.
+func (m *Mirrors) evict(now time.Time) {
+	type cached struct {
+		path     string
+		lastUsed time.Time
+	}
+
+	var mirrors []cached
+	err := filepath.WalkDir(m.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || !strings.HasSuffix(path, ".git") {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mirrors = append(mirrors, cached{path: path, lastUsed: info.ModTime()})
+		return filepath.SkipDir
+	})
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("unable to list the mirrors in %s: %v", m.dir, err)
+		return
+	}
+
+	// most recently used first
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrors[i].lastUsed.After(mirrors[j].lastUsed)
+	})
+
+	kept := 0
+	for _, mirror := range mirrors {
+		if m.inUse[mirror.path] > 0 {
+			kept++
+			continue
+		}
+
+		expired := m.maxAge > 0 && now.Sub(mirror.lastUsed) > m.maxAge
+		excess := m.maxRepos > 0 && kept >= m.maxRepos
+		if !expired && !excess {
+			kept++
+			continue
+		}
+
+		logrus.Infof("evicting mirror %s, last used %s", mirror.path, mirror.lastUsed)
+		err = os.RemoveAll(mirror.path)
+		if err != nil {
+			logrus.Warnf("unable to evict mirror %s: %v", mirror.path, err)
+		}
+		delete(m.locks, mirror.path)
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jenkins-x/go-scm/scm"
+)
+
+// MaintainPermission is github's maintain role, between write and admin. The other
+// servers have no such role, so their maintainers are reported as having write.
+const MaintainPermission = "maintain"
+
+// DefaultPermission is the permission on a repository needed to request backports
+// unless $BACKPORT_PERMISSION is set.
+const DefaultPermission = scm.WritePermission
+
+// permissionRanks orders the permissions, a permission that is not known ranks as none.
+var permissionRanks = map[string]int{
+	scm.NoPermission:    0,
+	scm.ReadPermission:  1,
+	"triage":            1,
+	scm.WritePermission: 2,
+	MaintainPermission:  3,
+	scm.AdminPermission: 4,
+}
+
+// Authorization decides who can request backports with a comment.
+type Authorization struct {
+	// Permission is the minimum permission on the repository, DefaultPermission
+	// when empty.
+	Permission string
+
+	// Teams are the teams, as org/team, whose members can request backports whatever
+	// their permission on the repository.
+	Teams []string
+}
+
+// AuthorizationFromEnv reads the minimum permission from $BACKPORT_PERMISSION and
+// the comma separated teams from $BACKPORT_TEAMS.
+func AuthorizationFromEnv() (Authorization, error) {
+	a := Authorization{Permission: os.Getenv("BACKPORT_PERMISSION")}
+	if err := validatePermission(a.Permission); err != nil {
+		return a, fmt.Errorf("invalid BACKPORT_PERMISSION %s: %w", a.Permission, err)
+	}
+
+	teams, err := parseTeams(strings.Split(os.Getenv("BACKPORT_TEAMS"), ","))
+	if err != nil {
+		return a, fmt.Errorf("invalid BACKPORT_TEAMS: %w", err)
+	}
+	a.Teams = teams
+
+	return a, nil
+}
+
+func validatePermission(permission string) error {
+	switch permission {
+	case "", scm.WritePermission, MaintainPermission, scm.AdminPermission:
+		return nil
+	}
+	return fmt.Errorf("unknown permission %s, expected %s, %s or %s", permission, scm.WritePermission, MaintainPermission, scm.AdminPermission)
+}
+
+func parseTeams(values []string) ([]string, error) {
+	var teams []string
+	for _, team := range values {
+		if team = strings.TrimSpace(team); team == "" {
+			continue
+		}
+		org, name, ok := strings.Cut(team, "/")
+		if !ok || org == "" || name == "" {
+			return nil, fmt.Errorf("team %s is not org/team", team)
+		}
+		teams = append(teams, team)
+	}
+	return teams, nil
+}
+
+// MinPermission returns the minimum permission on the repository.
+func (a Authorization) MinPermission() string {
+	if a.Permission == "" {
+		return DefaultPermission
+	}
+	return a.Permission
+}
+
+// HasPermission reports whether permission is at least the minimum.
+func (a Authorization) HasPermission(permission string) bool {
+	return permissionRanks[permission] >= permissionRanks[a.MinPermission()]
+}
+
+// FindUserPermission returns the user's permission on the repository, one of the
+// scm permissions or MaintainPermission.
+func (s *scmImpl) FindUserPermission(owner string, repo string, user string) (string, error) {
+	if s.server.Driver == DriverGitHub {
+		// the permission reports maintain and triage as write and read, the role does not
+		var permission struct {
+			Permission string `json:"permission"`
+			RoleName   string `json:"role_name"`
+		}
+		err := s.getJSON(fmt.Sprintf("repos/%s/%s/collaborators/%s/permission", owner, repo, url.PathEscape(user)), &permission)
+		if scm.IsScmNotFound(err) {
+			return scm.NoPermission, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, ok := permissionRanks[permission.RoleName]; ok {
+			return permission.RoleName, nil
+		}
+		return permission.Permission, nil
+	}
+
+	permission, _, err := s.client.Repositories.FindUserPermission(context.Background(), fmt.Sprintf("%s/%s", owner, repo), user)
+	if err != nil {
+		return "", err
+	}
+	if permission == "" {
+		return scm.NoPermission, nil
+	}
+	return permission, nil
+}
+
+// IsTeamMember reports whether the user is a member of the team, given as org/team,
+// which is a subgroup on gitlab. Bitbucket server has no teams.
+func (s *scmImpl) IsTeamMember(team string, user string) (bool, error) {
+	org, name, _ := strings.Cut(team, "/")
+
+	switch s.server.Driver {
+	case DriverGitHub:
+		var membership struct {
+			State string `json:"state"`
+		}
+		err := s.getJSON(fmt.Sprintf("orgs/%s/teams/%s/memberships/%s", org, name, url.PathEscape(user)), &membership)
+		if scm.IsScmNotFound(err) {
+			return false, nil
+		}
+		return membership.State == "active", err
+
+	case DriverGitea:
+		var search struct {
+			Data []struct {
+				ID   int64  `json:"id"`
+				Name string `json:"name"`
+			} `json:"data"`
+		}
+		err := s.getJSON(fmt.Sprintf("api/v1/orgs/%s/teams/search?q=%s", org, url.QueryEscape(name)), &search)
+		if err != nil {
+			return false, err
+		}
+		for _, t := range search.Data {
+			if !strings.EqualFold(t.Name, name) {
+				continue
+			}
+			var member struct{}
+			err := s.getJSON(fmt.Sprintf("api/v1/teams/%d/members/%s", t.ID, url.PathEscape(user)), &member)
+			if scm.IsScmNotFound(err) {
+				return false, nil
+			}
+			return err == nil, err
+		}
+		return false, nil
+
+	case DriverGitLab:
+		var members []struct {
+			Username string `json:"username"`
+		}
+		err := s.getJSON(fmt.Sprintf("api/v4/groups/%s/members/all?query=%s", url.PathEscape(team), url.QueryEscape(user)), &members)
+		if scm.IsScmNotFound(err) {
+			return false, nil
+		}
+		for _, member := range members {
+			if member.Username == user {
+				return true, nil
+			}
+		}
+		return false, err
+	}
+
+	return false, fmt.Errorf("teams are not supported by %s", s.server.Driver)
+}
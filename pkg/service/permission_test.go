@@ -0,0 +1,69 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationFromEnv(t *testing.T) {
+	type test struct {
+		name          string
+		permission    string
+		teams         string
+		allowed       []string
+		notAllowed    []string
+		expectedTeams []string
+		expectedError string
+	}
+
+	tests := []test{
+		{
+			name:       "defaults to write",
+			allowed:    []string{"write", "maintain", "admin"},
+			notAllowed: []string{"none", "read", "triage", "custom"},
+		},
+		{
+			name:          "maintainers and teams",
+			permission:    "maintain",
+			teams:         "org/release, org/maintainers",
+			allowed:       []string{"maintain", "admin"},
+			notAllowed:    []string{"read", "write"},
+			expectedTeams: []string{"org/release", "org/maintainers"},
+		},
+		{
+			name:          "unknown permission",
+			permission:    "owner",
+			expectedError: "invalid BACKPORT_PERMISSION owner: unknown permission owner, expected write, maintain or admin",
+		},
+		{
+			name:          "team without an org",
+			teams:         "release",
+			expectedError: "invalid BACKPORT_TEAMS: team release is not org/team",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BACKPORT_PERMISSION", test.permission)
+			t.Setenv("BACKPORT_TEAMS", test.teams)
+
+			a, err := service.AuthorizationFromEnv()
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedTeams, a.Teams)
+			for _, permission := range test.allowed {
+				assert.True(t, a.HasPermission(permission), permission)
+			}
+			for _, permission := range test.notAllowed {
+				assert.False(t, a.HasPermission(permission), permission)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BackportOfTrailer is the trailer that records the PR a commit was backported from,
+// it is what ListBackportsToBranch looks for.
+const BackportOfTrailer = "Backport-Of"
+
+// Backport is an upstream PR that has been backported to a branch.
+type Backport struct {
+	// PR identifies the upstream PR as owner/repo#number.
+	PR string `json:"pr"`
+	// Commits are the commits on the branch that were backported from the PR, newest
+	// first.
+	Commits []string `json:"commits"`
+}
+
+// trailersFromEnv reads the comma separated trailer templates from
+// $BACKPORT_TRAILERS, an empty value disables them. The older ${owner}, ${repo},
+// ${pr} and ${branch} placeholders are still replaced.
+func trailersFromEnv() []string {
+	s, ok := os.LookupEnv("BACKPORT_TRAILERS")
+	if !ok {
+		return DefaultTrailers
+	}
+
+	var trailers []string
+	for _, trailer := range strings.Split(s, ",") {
+		if trailer = strings.TrimSpace(trailer); trailer != "" {
+			trailers = append(trailers, legacyTemplate(trailer))
+		}
+	}
+	return trailers
+}
+
+// addTrailers amends the last commit to add the trailers to its message.
+func addTrailers(gitter *observableGitter, dir string, trailers []string) error {
+	if len(trailers) == 0 {
+		return nil
+	}
+
+	args := []string{"commit", "--amend", "--no-edit", "--no-verify"}
+	for _, trailer := range trailers {
+		args = append(args, "--trailer", trailer)
+	}
+	_, err := gitter.ExecuteGit(dir, args...)
+	return err
+}
+
+// ListBackportsToBranch lists the upstream PRs that have been backported to branch,
+// most recently backported first, by reading the Backport-Of trailers of its commits.
+func (s *scmImpl) ListBackportsToBranch(owner string, repo string, branch string) ([]Backport, error) {
+	dir, err := os.MkdirTemp("", "git-worker")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	authenticatedURL, err := s.authenticatedURL()
+	if err != nil {
+		return nil, err
+	}
+
+	// only the commits are needed, not their contents. The credentials are given as
+	// config rather than in the clone URL, and executeGit redacts them from its logs
+	_, err = executeGit(dir, "clone", "--config", fmt.Sprintf("url.%s.insteadOf=%s", authenticatedURL, s.server.URL),
+		"--bare", "--filter=blob:none", "--single-branch", "--branch", branch, s.cloneURL(owner, repo), repo)
+	if err != nil {
+		return nil, err
+	}
+
+	format := fmt.Sprintf("--format=%%H %%(trailers:key=%s,valueonly,separator=%%x20)", BackportOfTrailer)
+	out, err := executeGit(filepath.Join(dir, repo), "log", format, branch)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBackports(out), nil
+}
+
+// parseBackports groups the commits by the PR they were backported from, the output
+// has a line per commit with its sha followed by its Backport-Of trailers.
+func parseBackports(out string) []Backport {
+	var backports []Backport
+	index := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		commit := fields[0]
+		for _, pr := range fields[1:] {
+			i, ok := index[pr]
+			if !ok {
+				i = len(backports)
+				index[pr] = i
+				backports = append(backports, Backport{PR: pr})
+			}
+			backports[i].Commits = append(backports[i].Commits, commit)
+		}
+	}
+
+	logrus.Debugf("found %d backports", len(backports))
+	return backports
+}
@@ -5,52 +5,216 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/jenkins-x/go-scm/scm"
-	"github.com/jenkins-x/go-scm/scm/factory"
 	"github.com/sirupsen/logrus"
 )
 
 const (
+	// LabelPrefix prefixes the branch in the labels that request a backport, unless
+	// the repository configures another prefix.
 	LabelPrefix = "Backport to "
 	black       = "000000"
 )
 
 type Scm interface {
 	ListCommitsForPr(owner string, repo string, pr int) ([]string, error)
-	DetermineBranchesForPr(owner string, repo string, pr int) ([]string, error)
-	ApplyCommitsToRepo(owner string, repo string, pr int, branch string, commits []string) error
+	DetermineBranchesForPr(owner string, repo string, pr int, prefix string) ([]string, error)
+	ApplyCommitsToRepo(owner string, repo string, pr int, branch string, commits []string, opts BackportOptions) (BackportResult, error)
 	ListBranchesForRepo(owner string, repo string) ([]string, error)
 	AddCommentToPr(owner string, repo string, pr int, comment string) error
+	FindCommentOnPr(owner string, repo string, pr int, marker string) (int, string, error)
+	EditCommentOnPr(owner string, repo string, pr int, id int, comment string) error
 	AddLabelToPr(owner string, repo string, pr int, label string) error
+	RemoveLabelFromPr(owner string, repo string, pr int, label string) error
+	AddBackportBranchToPr(owner string, repo string, pr int, branch string, prefix string) error
+	RemoveBackportBranchFromPr(owner string, repo string, pr int, branch string, prefix string) error
+	IsPrMerged(owner string, repo string, pr int) (bool, error)
+	ClosePr(owner string, repo string, pr int) error
+	FindBackportPr(owner string, repo string, pr int, branch string, opts BackportOptions) (*scm.PullRequest, error)
+	ListBackportsToBranch(owner string, repo string, branch string) ([]Backport, error)
+	FindDefaultBranchSha(owner string, repo string) (string, error)
+	ReadFileFromRepo(owner string, repo string, path string, ref string) ([]byte, error)
+	CountApprovalsForPr(owner string, repo string, pr int) (int, error)
+	FindUserPermission(owner string, repo string, user string) (string, error)
+	IsTeamMember(team string, user string) (bool, error)
+	AuthenticatedLogin() (string, error)
+}
+
+// BackportOptions configures how the commits are applied to the branch.
+type BackportOptions struct {
+	// AllowConflicts commits a conflicting cherry-pick and opens a draft PR for the
+	// conflicts to be resolved by hand, rather than giving up.
+	AllowConflicts bool
+
+	// Templates render the backport branch name, the title and body of the backport
+	// PR and the trailers added to each backported commit, DefaultTemplates when nil.
+	Templates *Templates
+
+	// Mirrors, when set, checks out the branch from a cached mirror of the repository
+	// rather than cloning it.
+	Mirrors *Mirrors
+
+	// Copy lists the fields of the source PR that are copied to the backport PR,
+	// RepoCopy overrides it for the repositories it has, by owner/repo.
+	Copy     []string
+	RepoCopy map[string][]string
+
+	// LabelPrefix prefixes the branch in the labels that request a backport, which are
+	// not copied, defaults to LabelPrefix.
+	LabelPrefix string
+
+	// CloseCancelled closes the backport PR when its backport is cancelled, rather than
+	// leaving it open.
+	CloseCancelled bool
+}
+
+// labelPrefix returns the prefix of the labels that request a backport.
+func (o BackportOptions) labelPrefix() string {
+	if o.LabelPrefix == "" {
+		return LabelPrefix
+	}
+	return o.LabelPrefix
+}
+
+// templates returns the templates, or the defaults if there are none.
+func (o BackportOptions) templates() *Templates {
+	if o.Templates == nil {
+		return DefaultTemplates
+	}
+	return o.Templates
+}
+
+// BackportOptionsFromEnv reads the options from $BACKPORT_ALLOW_CONFLICTS,
+// $BACKPORT_COPY, $BACKPORT_COPY_REPOS, the $BACKPORT_*_TEMPLATE variables and
+// $BACKPORT_TRAILERS of the templates and the $BACKPORT_CACHE_* variables of the
+// mirrors.
+func BackportOptionsFromEnv() (BackportOptions, error) {
+	mirrors, err := MirrorsFromEnv()
+	if err != nil {
+		return BackportOptions{}, err
+	}
+
+	fields, repos, err := copyFromEnv()
+	if err != nil {
+		return BackportOptions{}, err
+	}
+
+	templates, err := TemplatesFromEnv()
+	if err != nil {
+		return BackportOptions{}, err
+	}
+
+	opts := BackportOptions{
+		Templates: templates,
+		Mirrors:   mirrors,
+		Copy:      fields,
+		RepoCopy:  repos,
+	}
+
+	if s := os.Getenv("BACKPORT_ALLOW_CONFLICTS"); s != "" {
+		allow, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid BACKPORT_ALLOW_CONFLICTS %s: %w", s, err)
+		}
+		opts.AllowConflicts = allow
+	}
+
+	if s := os.Getenv("BACKPORT_CLOSE_CANCELLED"); s != "" {
+		closeCancelled, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid BACKPORT_CLOSE_CANCELLED %s: %w", s, err)
+		}
+		opts.CloseCancelled = closeCancelled
+	}
+
+	return opts, nil
+}
+
+// BackportResult describes the backport of a PR to a branch.
+type BackportResult struct {
+	Branch string `json:"branch"`
+	// Number and Link identify the backport PR, when one was created or updated.
+	Number int    `json:"number,omitempty"`
+	Link   string `json:"link,omitempty"`
+	// Updated is set when an existing backport PR was updated rather than created.
+	Updated bool `json:"updated,omitempty"`
+	// Existing is set when the PR had already been backported and nothing was done.
+	Existing bool `json:"existing,omitempty"`
+	// InProgress is set when the backport was already being applied for another
+	// request and nothing was done, that request records how it went.
+	InProgress bool `json:"inProgress,omitempty"`
+	// Conflict is the commit whose conflicts were committed for resolving by hand.
+	Conflict string `json:"conflict,omitempty"`
+	// Log holds the git commands that were run and their output, as markdown.
+	Log string `json:"-"`
+}
+
+// CherryPickError is returned when a commit cannot be cherry-picked onto the branch,
+// usually because of a conflict.
+type CherryPickError struct {
+	Commit string
+	Err    error
+}
+
+func (e *CherryPickError) Error() string {
+	return fmt.Sprintf("unable to cherry-pick %s: %v", e.Commit, e.Err)
+}
+
+func (e *CherryPickError) Unwrap() error {
+	return e.Err
 }
 
 type scmImpl struct {
 	client   *scm.Client
-	host     string
+	server   Server
 	username string
 	token    string
+	// name and email identify the author of backport commits.
+	name    string
+	email   string
+	intents IntentStore
+
+	mu sync.Mutex
+	// login is the login of the user the scm authenticates as, it is looked up when
+	// it is first needed unless it is known up front.
+	login string
 }
 
-func NewScm(host string, username string, token string) Scm {
-	c, err := factory.NewClient("github", host, token)
+func NewScm(server Server, username string, token string) Scm {
+	c, err := NewClient(server, token)
 	if err != nil {
 		panic(err)
 	}
-	return &scmImpl{
+	s := &scmImpl{
 		client:   c,
-		host:     host,
+		server:   server,
 		username: username,
 		token:    token,
+		name:     username,
+		email:    fmt.Sprintf("%s@users.noreply.%s", username, hostname(server.URL)),
 	}
+	s.intents = NewIntentStore(s)
+	return s
 }
 
 func (s *scmImpl) ListCommitsForPr(owner string, repo string, pr int) ([]string, error) {
+	// the gitea and bitbucket server drivers do not support listing the commits of a PR
+	switch s.server.Driver {
+	case DriverGitea:
+		return s.listGiteaCommitsForPr(owner, repo, pr)
+	case DriverBitbucketServer:
+		return s.listStashCommitsForPr(owner, repo, pr)
+	}
+
 	// convert these into commits
 	commits, _, err := s.client.PullRequests.ListCommits(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, &scm.ListOptions{})
 	if err != nil {
@@ -66,125 +230,380 @@ func (s *scmImpl) ListCommitsForPr(owner string, repo string, pr int) ([]string,
 	return c, nil
 }
 
-func (s *scmImpl) DetermineBranchesForPr(owner string, repo string, pr int) ([]string, error) {
+func (s *scmImpl) DetermineBranchesForPr(owner string, repo string, pr int, prefix string) ([]string, error) {
 	logrus.Infof("Determining branches for %s/%s/pulls/%d", owner, repo, pr)
-	// convert these into commits
-	pullRequest, _, err := s.client.PullRequests.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr)
-	if err != nil {
-		return nil, err
-	}
+	return s.intents.Branches(owner, repo, pr, prefix)
+}
 
-	var branches []string
-	for _, label := range pullRequest.Labels {
-		if strings.HasPrefix(label.Name, LabelPrefix) {
-			branches = append(branches, strings.TrimPrefix(label.Name, LabelPrefix))
-		}
-	}
+func (s *scmImpl) AddBackportBranchToPr(owner string, repo string, pr int, branch string, prefix string) error {
+	logrus.Infof("Requesting backport of %s/%s/pulls/%d to %s", owner, repo, pr, branch)
+	return s.intents.Add(owner, repo, pr, branch, prefix)
+}
 
-	return branches, nil
+// RemoveBackportBranchFromPr withdraws the request for pr to be backported to branch.
+func (s *scmImpl) RemoveBackportBranchFromPr(owner string, repo string, pr int, branch string, prefix string) error {
+	logrus.Infof("Withdrawing backport of %s/%s/pulls/%d to %s", owner, repo, pr, branch)
+	return s.intents.Remove(owner, repo, pr, branch, prefix)
 }
 
-func (s *scmImpl) ApplyCommitsToRepo(owner string, repo string, pr int, branch string, commits []string) error {
+func (s *scmImpl) ApplyCommitsToRepo(owner string, repo string, pr int, branch string, commits []string, opts BackportOptions) (BackportResult, error) {
 	gitter := NewGitter()
+	result := BackportResult{Branch: branch}
+	done := func(err error) (BackportResult, error) {
+		result.Log = gitter.Log()
+		return result, err
+	}
 
 	logrus.Infof("Applying commits to repo for %s/%s/pulls/%d", owner, repo, pr)
-	// clone repository to a temporary directory
-	file, err := os.MkdirTemp("", "git-worker")
+
+	source, _, err := s.client.PullRequests.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr)
 	if err != nil {
-		logrus.Fatalf("unable to create temp dir %v", err)
+		return done(err)
 	}
-	defer os.RemoveAll(file)
 
-	logrus.Infof("running in directory %s", file)
-
-	gitURL := fmt.Sprintf("%s/%s/%s", s.host, owner, repo)
-	_, err = gitter.ExecuteGit(file, "clone", gitURL)
+	templates := opts.templates().forCopy(opts.CopyFor(owner, repo))
+	data := newTemplateData(owner, repo, source, branch, commits)
+	prInput, err := templates.PullRequestInput(data)
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
 	}
 
-	path := filepath.Join(file, repo)
+	trailers, err := templates.RenderTrailers(data)
+	if err != nil {
+		return done(err)
+	}
 
-	_, err = gitter.ExecuteGit(path, "checkout", branch)
+	path, cleanup, err := s.checkout(&gitter, owner, repo, branch, opts.Mirrors)
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
 	}
+	defer cleanup()
+
+	logrus.Infof("running in directory %s", path)
 
 	// determine a unique branch name
-	backportBranchName := fmt.Sprintf("backport-PR-%d-to-%s", pr, branch)
-	_, err = gitter.ExecuteGit(path, "checkout", "-b", backportBranchName)
+	backportBranchName := prInput.Head
+	_, err = gitter.ExecuteGit(path, "checkout", "-B", backportBranchName)
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
 	}
 
-	_, err = gitter.ExecuteGit(path, "config", "user.email", fmt.Sprintf("%s@users.noreply.github.com", s.username))
+	_, err = gitter.ExecuteGit(path, "config", "--worktree", "user.email", s.email)
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
 	}
 
-	_, err = gitter.ExecuteGit(path, "config", "user.name", s.username)
+	_, err = gitter.ExecuteGit(path, "config", "--worktree", "user.name", s.name)
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
 	}
 
-	// apply commits in order
-	for _, commit := range commits {
-		logrus.Infof("cherry-picking %s", commit)
-		_, err = gitter.ExecuteGit(path, "cherry-pick", commit)
+	// apply commits in order, recording where each one came from
+	picks := s.commitsToPick(path, owner, repo, source, commits)
+	var conflicted *conflict
+	for i, p := range picks {
+		logrus.Infof("cherry-picking %s", p.Commit)
+		args := []string{"cherry-pick", "-x"}
+		if p.Mainline {
+			args = append(args, "-m", "1")
+		}
+		_, err = gitter.ExecuteGit(path, append(args, p.Commit)...)
+		if err != nil && opts.AllowConflicts {
+			conflicted, err = commitConflicts(&gitter, path, p.Commit, remaining(picks[i+1:]), err)
+		}
+		if err == nil {
+			err = addTrailers(&gitter, path, trailers)
+		}
 		if err != nil {
-			gitter.Messages = append(gitter.Messages, "```")
-			_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-			return err
+			return done(&CherryPickError{Commit: p.Commit, Err: err})
+		}
+		if conflicted != nil {
+			// the rest are left until the conflicts have been resolved
+			result.Conflict = conflicted.Commit
+			break
 		}
 	}
 
 	// don't use the gitter to avoid logging
-	_, err = executeGit(path, "config", fmt.Sprintf("url.https://%s:%s@github.com.insteadOf", s.username, s.token), "https://github.com")
+	authenticatedURL, err := s.authenticatedURL()
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
 	}
 
+	_, err = executeGit(path, "config", "--worktree", fmt.Sprintf("url.%s.insteadOf", authenticatedURL), s.server.URL)
+	if err != nil {
+		return done(err)
+	}
+
+	// the backport branch is left behind by an earlier attempt that failed to create
+	// the PR, or is being updated, so it is replaced with the new cherry-picks.
 	logrus.Infof("pushing %s", backportBranchName)
-	_, err = gitter.ExecuteGit(path, "push", "origin", backportBranchName)
+	_, err = gitter.ExecuteGit(path, "push", "--force-with-lease", "origin", backportBranchName)
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
+	}
+
+	existing, err := s.findBackportPr(owner, repo, backportBranchName)
+	if err != nil {
+		return done(err)
+	}
+
+	// a PR that was closed without being merged is replaced with a new one
+	if existing != nil && !existing.Closed {
+		logrus.Infof("updated PR-%d", existing.Number)
+		if conflicted != nil {
+			err = s.AddLabelToPr(owner, repo, existing.Number, ConflictLabel)
+			if err != nil {
+				return done(err)
+			}
+		}
+		result.Number, result.Link, result.Updated = existing.Number, existing.Link, true
+		return done(nil)
 	}
 
 	logrus.Infof("creating PR")
-	prInput := scm.PullRequestInput{
-		Title: fmt.Sprintf("Backporting PR-%d to %s", pr, branch),
-		Head:  backportBranchName,
-		Base:  branch,
-		Body:  fmt.Sprintf("Backport from %s/%s/%s/pulls/%d", s.host, owner, repo, pr),
+	fields := opts.CopyFor(owner, repo)
+	if conflicted != nil {
+		prInput.Body += "\n\n" + conflicted.description()
 	}
 
-	pullRequest, _, err := s.client.PullRequests.Create(context.Background(), fmt.Sprintf("%s/%s", owner, repo), &prInput)
+	pullRequest, err := s.createPullRequest(owner, repo, &prInput, conflicted != nil)
 	if err != nil {
-		gitter.Messages = append(gitter.Messages, "```")
-		_ = s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
-		return err
+		return done(err)
 	}
+	result.Number, result.Link = pullRequest.Number, pullRequest.Link
 
-	gitter.Messages = append(gitter.Messages, "```")
-	gitter.Messages = append(gitter.Messages, fmt.Sprintf("Created PR %s/%s/%s/pulls/%d", s.host, owner, repo, pullRequest.Number))
+	s.copyMetadata(owner, repo, source, pullRequest.Number, fields, opts.labelPrefix())
 
-	// if this fails at any point, create an issue on the repo with labels and the error message
+	if conflicted != nil {
+		err = s.AddLabelToPr(owner, repo, pullRequest.Number, ConflictLabel)
+		if err != nil {
+			return done(err)
+		}
+	}
 
-	return s.AddCommentToPr(owner, repo, pr, strings.Join(gitter.Messages, "\n"))
+	return done(nil)
+}
+
+// checkout checks out branch of the repository in a new directory, a worktree of
+// the repository's mirror or else a fresh clone, returning it along with a func that
+// removes it.
+func (s *scmImpl) checkout(gitter *observableGitter, owner string, repo string, branch string, mirrors *Mirrors) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "git-worker")
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, repo)
+
+	credentials, err := s.credentials()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	if mirrors != nil {
+		remove, err := mirrors.worktree(gitter, credentials, s.cloneURL(owner, repo), branch, path)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return "", nil, err
+		}
+		return path, func() {
+			remove()
+			_ = os.RemoveAll(dir)
+		}, nil
+	}
+
+	_, err = gitter.ExecuteGit(dir, append(credentials, "clone", s.cloneURL(owner, repo), repo)...)
+	if err == nil {
+		_, err = gitter.ExecuteGit(path, "checkout", branch)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return path, func() { _ = os.RemoveAll(dir) }, nil
+}
+
+// cloneURL returns the http URL the repository can be cloned from.
+func (s *scmImpl) cloneURL(owner string, repo string) string {
+	if s.server.Driver == DriverBitbucketServer {
+		return fmt.Sprintf("%s/scm/%s/%s.git", s.server.URL, owner, repo)
+	}
+	return fmt.Sprintf("%s/%s/%s", s.server.URL, owner, repo)
+}
+
+// authenticatedURL returns the server URL with the credentials embedded, so that
+// git can push without prompting.
+func (s *scmImpl) authenticatedURL() (string, error) {
+	u, err := url.Parse(s.server.URL)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(s.username, s.token)
+	return u.String(), nil
+}
+
+// credentials returns the options that authenticate a single git command with the
+// server, so that private repositories can be fetched without the credentials being
+// stored in their config.
+func (s *scmImpl) credentials() ([]string, error) {
+	authenticatedURL, err := s.authenticatedURL()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-c", fmt.Sprintf("url.%s.insteadOf=%s", authenticatedURL, s.server.URL)}, nil
+}
+
+func (s *scmImpl) IsPrMerged(owner string, repo string, pr int) (bool, error) {
+	pullRequest, _, err := s.client.PullRequests.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr)
+	if err != nil {
+		return false, err
+	}
+
+	return pullRequest.Merged, nil
+}
+
+// ClosePr closes pr without merging it.
+func (s *scmImpl) ClosePr(owner string, repo string, pr int) error {
+	logrus.Infof("Closing %s/%s/pulls/%d", owner, repo, pr)
+	_, err := s.client.PullRequests.Close(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr)
+	return err
+}
+
+// FindBackportPr returns the PR that backports pr to branch, or nil if no such PR has
+// been created.
+func (s *scmImpl) FindBackportPr(owner string, repo string, pr int, branch string, opts BackportOptions) (*scm.PullRequest, error) {
+	source, _, err := s.client.PullRequests.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr)
+	if err != nil {
+		return nil, err
+	}
+
+	commits, err := s.ListCommitsForPr(owner, repo, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := opts.templates().BranchName(newTemplateData(owner, repo, source, branch, commits))
+	if err != nil {
+		return nil, err
+	}
+	return s.findBackportPr(owner, repo, head)
+}
+
+// findBackportPr returns the PR from the backport branch head, or nil if no such PR
+// has been created. An open or merged PR is preferred to one that was closed without
+// being merged, which is only returned if there is no other.
+func (s *scmImpl) findBackportPr(owner string, repo string, head string) (*scm.PullRequest, error) {
+	var candidates []backportCandidate
+	var err error
+	switch s.server.Driver {
+	case DriverBitbucketServer:
+		candidates, err = s.findStashBackportPrs(owner, repo, head)
+	case DriverGitHub:
+		candidates, err = s.findGitHubBackportPrs(owner, repo, head)
+	case DriverGitLab:
+		candidates, err = s.findGitLabBackportPrs(owner, repo, head)
+	default:
+		return s.listBackportPrs(owner, repo, head)
+	}
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+
+	number := candidates[0].number
+	for _, candidate := range candidates {
+		if !candidate.closed {
+			number = candidate.number
+			break
+		}
+	}
+
+	pullRequest, _, err := s.client.PullRequests.Find(context.Background(), fmt.Sprintf("%s/%s", owner, repo), number)
+	return pullRequest, err
+}
+
+// backportCandidate is a PR from the backport branch, closed is set when it was
+// closed without being merged.
+type backportCandidate struct {
+	number int
+	closed bool
+}
+
+// findGitHubBackportPrs returns the PRs from the backport branch head of the
+// repository, newest first.
+func (s *scmImpl) findGitHubBackportPrs(owner string, repo string, head string) ([]backportCandidate, error) {
+	var pullRequests []struct {
+		Number   int     `json:"number"`
+		State    string  `json:"state"`
+		MergedAt *string `json:"merged_at"`
+	}
+	params := url.Values{}
+	params.Set("head", owner+":"+head)
+	params.Set("state", "all")
+	params.Set("per_page", "100")
+	err := s.getJSON(fmt.Sprintf("repos/%s/%s/pulls?%s", owner, repo, params.Encode()), &pullRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []backportCandidate
+	for _, pr := range pullRequests {
+		candidates = append(candidates, backportCandidate{number: pr.Number, closed: pr.State == "closed" && pr.MergedAt == nil})
+	}
+	return candidates, nil
+}
+
+// findGitLabBackportPrs returns the merge requests from the backport branch head of
+// the project, newest first.
+func (s *scmImpl) findGitLabBackportPrs(owner string, repo string, head string) ([]backportCandidate, error) {
+	var mergeRequests []struct {
+		IID   int    `json:"iid"`
+		State string `json:"state"`
+	}
+	params := url.Values{}
+	params.Set("source_branch", head)
+	params.Set("state", "all")
+	params.Set("per_page", "100")
+	err := s.getJSON(fmt.Sprintf("api/v4/projects/%s/merge_requests?%s", url.PathEscape(owner+"/"+repo), params.Encode()), &mergeRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []backportCandidate
+	for _, mr := range mergeRequests {
+		candidates = append(candidates, backportCandidate{number: mr.IID, closed: mr.State == "closed"})
+	}
+	return candidates, nil
+}
+
+// listBackportPrs pages through the PRs of the repository for those from the backport
+// branch head, for the servers that cannot filter the PRs by their head.
+func (s *scmImpl) listBackportPrs(owner string, repo string, head string) (*scm.PullRequest, error) {
+	var closed *scm.PullRequest
+	opts := &scm.PullRequestListOptions{Page: 1, Size: 100, Open: true, Closed: true}
+	for {
+		pullRequests, resp, err := s.client.PullRequests.List(context.Background(), fmt.Sprintf("%s/%s", owner, repo), opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pullRequest := range pullRequests {
+			if pullRequest.Source != head && pullRequest.Head.Ref != head {
+				continue
+			}
+			if !pullRequest.Closed || pullRequest.Merged {
+				return pullRequest, nil
+			}
+			if closed == nil {
+				closed = pullRequest
+			}
+		}
+
+		if resp == nil || resp.Page.Next == 0 {
+			return closed, nil
+		}
+		opts.Page = resp.Page.Next
+	}
 }
 
 func (s *scmImpl) AddCommentToPr(owner string, repo string, pr int, comment string) error {
@@ -194,90 +613,158 @@ func (s *scmImpl) AddCommentToPr(owner string, repo string, pr int, comment stri
 	return err
 }
 
-func (s *scmImpl) AddLabelToPr(owner string, repo string, pr int, labelName string) error {
-	logrus.Infof("Applying label %s to repo for %s/%s/pulls/%d", labelName, owner, repo, pr)
-
-	labels, _, err := s.client.Repositories.ListLabels(context.Background(), fmt.Sprintf("%s/%s", owner, repo), &scm.ListOptions{})
+// FindCommentOnPr returns the id and body of the first comment on pr that contains
+// marker, or 0 if there is no such comment. Only the comments made by the user the scm
+// authenticates as are considered, so that a comment quoting the marker is not
+// mistaken for one of ours.
+func (s *scmImpl) FindCommentOnPr(owner string, repo string, pr int, marker string) (int, string, error) {
+	login, err := s.AuthenticatedLogin()
 	if err != nil {
-		return err
+		return 0, "", err
 	}
 
-	exists := false
-	for _, label := range labels {
-		if label.Name == labelName {
-			exists = true
+	opts := &scm.ListOptions{Page: 1, Size: 100}
+	for {
+		comments, resp, err := s.client.PullRequests.ListComments(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, opts)
+		if err != nil {
+			return 0, "", err
+		}
+
+		for _, comment := range comments {
+			// the bitbucket server login is the user's slug, which is lower case
+			if strings.Contains(comment.Body, marker) && strings.EqualFold(comment.Author.Login, login) {
+				return comment.ID, comment.Body, nil
+			}
 		}
+
+		if resp == nil || resp.Page.Next == 0 {
+			return 0, "", nil
+		}
+		opts.Page = resp.Page.Next
 	}
+}
+
+// AuthenticatedLogin returns the login of the user the scm authenticates as, which
+// the username of its credentials need not be, looking it up the first time.
+func (s *scmImpl) AuthenticatedLogin() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if !exists {
-		path := fmt.Sprintf("repos/%s/%s/labels", owner, repo)
-		data, err := json.Marshal(label{
-			name:  labelName,
-			color: black,
-		})
+	if s.login == "" {
+		user, _, err := s.client.Users.Find(context.Background())
 		if err != nil {
-			return err
+			return "", fmt.Errorf("unable to find the authenticated user: %w", err)
 		}
-		req := &scm.Request{Method: "POST", Path: path, Body: bytes.NewReader(data)}
-		_, err = s.client.Do(context.Background(), req)
+		s.login = user.Login
+	}
+	return s.login, nil
+}
+
+// EditCommentOnPr replaces the body of the comment on pr with the id.
+func (s *scmImpl) EditCommentOnPr(owner string, repo string, pr int, id int, comment string) error {
+	_, _, err := s.client.PullRequests.EditComment(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, id, &scm.CommentInput{
+		Body: comment,
+	})
+	return err
+}
+
+func (s *scmImpl) AddLabelToPr(owner string, repo string, pr int, labelName string) error {
+	logrus.Infof("Applying label %s to repo for %s/%s/pulls/%d", labelName, owner, repo, pr)
+
+	// gitlab and gitea create missing labels when they are added to a PR, bitbucket
+	// server has no labels and go-scm records them as comments.
+	if s.server.Driver == DriverGitHub {
+		err := s.ensureLabelExists(owner, repo, labelName)
 		if err != nil {
 			return err
 		}
 	}
 
 	// convert these into commits
-	_, err = s.client.PullRequests.AddLabel(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, labelName)
+	_, err := s.client.PullRequests.AddLabel(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, labelName)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *scmImpl) ListBranchesForRepo(owner string, repo string) ([]string, error) {
-	var branchesToReturn []string
-	path := fmt.Sprintf("repos/%s/%s/branches", owner, repo)
-	req := &scm.Request{Method: "GET", Path: path, Body: nil}
-	resp, err := s.client.Do(context.Background(), req)
-	if err != nil {
-		return branchesToReturn, err
-	}
+// RemoveLabelFromPr removes the label from pr, a label the PR does not have is ignored.
+func (s *scmImpl) RemoveLabelFromPr(owner string, repo string, pr int, labelName string) error {
+	logrus.Infof("Removing label %s from %s/%s/pulls/%d", labelName, owner, repo, pr)
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return branchesToReturn, err
+	_, err := s.client.PullRequests.DeleteLabel(context.Background(), fmt.Sprintf("%s/%s", owner, repo), pr, labelName)
+	if scm.IsScmNotFound(err) {
+		return nil
 	}
+	return err
+}
 
-	var branches []branch
-	err = json.Unmarshal(body, &branches)
+func (s *scmImpl) ensureLabelExists(owner string, repo string, labelName string) error {
+	labels, _, err := s.client.Repositories.ListLabels(context.Background(), fmt.Sprintf("%s/%s", owner, repo), &scm.ListOptions{})
 	if err != nil {
-		return branchesToReturn, err
+		return err
 	}
 
-	for _, branch := range branches {
-		branchesToReturn = append(branchesToReturn, branch.name)
+	for _, label := range labels {
+		if label.Name == labelName {
+			return nil
+		}
 	}
 
-	return branchesToReturn, nil
+	path := fmt.Sprintf("repos/%s/%s/labels", owner, repo)
+	data, err := json.Marshal(label{
+		Name:  labelName,
+		Color: black,
+	})
+	if err != nil {
+		return err
+	}
+	req := &scm.Request{Method: "POST", Path: path, Body: bytes.NewReader(data)}
+	_, err = s.client.Do(context.Background(), req)
+	return err
 }
 
-type label struct {
-	name  string
-	color string
+func (s *scmImpl) ListBranchesForRepo(owner string, repo string) ([]string, error) {
+	var branchesToReturn []string
+	opts := &scm.ListOptions{Page: 1, Size: 100}
+	for {
+		branches, resp, err := s.client.Git.ListBranches(context.Background(), fmt.Sprintf("%s/%s", owner, repo), opts)
+		if err != nil {
+			return branchesToReturn, err
+		}
+
+		for _, branch := range branches {
+			branchesToReturn = append(branchesToReturn, branch.Name)
+		}
+
+		if resp == nil || resp.Page.Next == 0 {
+			return branchesToReturn, nil
+		}
+		opts.Page = resp.Page.Next
+	}
 }
 
-type branch struct {
-	name string
+type label struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
 }
 
 func executeGit(dir string, args ...string) (string, error) {
-	logrus.Infof("> git %s in dir %s", strings.Join(args, " "), dir)
+	logrus.Infof("> git %s in dir %s", redact(strings.Join(args, " ")), dir)
 	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
 	stdout, err := cmd.CombinedOutput()
-	logrus.Infof("< %s", stdout)
+	logrus.Infof("< %s", redact(string(stdout)))
 	return string(stdout), err
 }
 
+var passwordPattern = regexp.MustCompile(`(://[^/:@\s]*):[^/@\s]+@`)
+
+// redact hides the passwords of any URLs in s, such as those of authenticatedURL.
+func redact(s string) string {
+	return passwordPattern.ReplaceAllString(s, "$1:xxxxx@")
+}
+
 func NewGitter() observableGitter {
 	return observableGitter{
 		Messages: []string{"```"},
@@ -288,10 +775,15 @@ type observableGitter struct {
 	Messages []string
 }
 
+// Log returns the commands that were run and their output as a markdown code block.
+func (o *observableGitter) Log() string {
+	return strings.Join(append(o.Messages, "```"), "\n")
+}
+
 func (o *observableGitter) ExecuteGit(dir string, args ...string) (string, error) {
-	o.Messages = append(o.Messages, fmt.Sprintf("git %s", strings.Join(args, " ")))
+	o.Messages = append(o.Messages, fmt.Sprintf("git %s", redact(strings.Join(args, " "))))
 	output, err := executeGit(dir, args...)
-	o.Messages = append(o.Messages, output)
+	o.Messages = append(o.Messages, redact(output))
 
 	return output, err
 }
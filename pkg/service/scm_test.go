@@ -0,0 +1,81 @@
+package service_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindBackportPr(t *testing.T) {
+	type test struct {
+		name     string
+		backport string
+		expected int
+	}
+
+	tests := []test{
+		{
+			name:     "no backport PR",
+			backport: `[]`,
+		},
+		{
+			name:     "open PR preferred to one that was closed",
+			backport: `[{"number":7,"state":"closed","merged_at":null},{"number":8,"state":"open","merged_at":null}]`,
+			expected: 8,
+		},
+		{
+			name:     "merged PR",
+			backport: `[{"number":7,"state":"closed","merged_at":"2023-03-17T10:43:11Z"}]`,
+			expected: 7,
+		},
+		{
+			name:     "PR that was closed without being merged",
+			backport: `[{"number":7,"state":"closed","merged_at":null}]`,
+			expected: 7,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v3/repos/org/repo/pulls", func(w http.ResponseWriter, r *http.Request) {
+				// the PRs are filtered by the backport branch rather than listing them all
+				assert.Equal(t, "org:backport-PR-1-to-1.x", r.URL.Query().Get("head"))
+				assert.Equal(t, "all", r.URL.Query().Get("state"))
+				fmt.Fprint(w, test.backport)
+			})
+			mux.HandleFunc("/api/v3/repos/org/repo/pulls/", func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v3/repos/org/repo/pulls/1":
+					fmt.Fprint(w, `{"number":1,"title":"Fix a bug","head":{"ref":"fix"},"base":{"ref":"main"}}`)
+				case "/api/v3/repos/org/repo/pulls/1/commits":
+					fmt.Fprint(w, `[{"sha":"abc123"}]`)
+				default:
+					var number int
+					_, err := fmt.Sscanf(r.URL.Path, "/api/v3/repos/org/repo/pulls/%d", &number)
+					require.NoError(t, err)
+					fmt.Fprintf(w, `{"number":%d,"head":{"ref":"backport-PR-1-to-1.x"},"base":{"ref":"1.x"}}`, number)
+				}
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			s := service.NewScm(service.Server{Driver: service.DriverGitHub, URL: server.URL}, "backport", "token")
+
+			backport, err := s.FindBackportPr("org", "repo", 1, "1.x", service.BackportOptions{})
+			require.NoError(t, err)
+			if test.expected == 0 {
+				assert.Nil(t, backport)
+				return
+			}
+			require.NotNil(t, backport)
+			assert.Equal(t, test.expected, backport.Number)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"net/url"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/factory"
+)
+
+const (
+	DriverGitHub = "github"
+	DriverGitLab = "gitlab"
+	DriverGitea  = "gitea"
+	// DriverBitbucketServer is bitbucket server / data center, which go-scm calls stash.
+	DriverBitbucketServer = "stash"
+)
+
+// Server identifies the git server hosting a repository.
+type Server struct {
+	// Driver is the go-scm driver used to talk to the server, e.g. github, gitlab, gitea or stash.
+	Driver string
+	// URL is the base URL of the server, e.g. https://github.com.
+	URL string
+	// Installation is the id of the github app installation that sent the webhook,
+	// or 0 if it was not sent by an app.
+	Installation int64
+}
+
+// DefaultURL returns the URL of the public instance of driver, bitbucket server is
+// always self-hosted so has no default.
+func DefaultURL(driver string) string {
+	switch driver {
+	case DriverGitLab:
+		return "https://gitlab.com"
+	case DriverGitea:
+		return "https://gitea.com"
+	case DriverBitbucketServer:
+		return ""
+	default:
+		return "https://github.com"
+	}
+}
+
+// NewClient creates a go-scm client for the server authenticated with token.
+func NewClient(server Server, token string) (*scm.Client, error) {
+	return factory.NewClient(server.Driver, server.URL, token)
+}
+
+// hostname returns the host of the server URL, used for noreply email addresses.
+func hostname(serverURL string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Hostname() == "" {
+		return "github.com"
+	}
+	return u.Hostname()
+}
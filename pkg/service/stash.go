@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+)
+
+const stashPageSize = 100
+
+type stashPage struct {
+	Values []struct {
+		ID json.RawMessage `json:"id"`
+		// State is the state of a PR, a declined PR was closed without being merged.
+		State string `json:"state"`
+	} `json:"values"`
+	IsLastPage    bool `json:"isLastPage"`
+	NextPageStart int  `json:"nextPageStart"`
+}
+
+// listStashCommitsForPr lists the commits of a PR, oldest first, which the
+// bitbucket server driver does not support.
+func (s *scmImpl) listStashCommitsForPr(owner string, repo string, pr int) ([]string, error) {
+	var c []string
+	err := s.stashPages(fmt.Sprintf("rest/api/1.0/projects/%s/repos/%s/pull-requests/%d/commits", owner, repo, pr), url.Values{}, func(page *stashPage) error {
+		for _, value := range page.Values {
+			var sha string
+			err := json.Unmarshal(value.ID, &sha)
+			if err != nil {
+				return err
+			}
+			c = append(c, sha)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// bitbucket returns the newest commit first
+	for i, j := 0, len(c)-1; i < j; i, j = i+1, j-1 {
+		c[i], c[j] = c[j], c[i]
+	}
+
+	logrus.Infof("got commits %s", c)
+	return c, nil
+}
+
+// findStashBackportPrs returns the PRs from the backport branch, the bitbucket server
+// driver ignores the state and paging options when listing PRs.
+func (s *scmImpl) findStashBackportPrs(owner string, repo string, head string) ([]backportCandidate, error) {
+	params := url.Values{}
+	params.Set("state", "ALL")
+	params.Set("direction", "OUTGOING")
+	params.Set("at", "refs/heads/"+head)
+
+	var candidates []backportCandidate
+	err := s.stashPages(fmt.Sprintf("rest/api/1.0/projects/%s/repos/%s/pull-requests", owner, repo), params, func(page *stashPage) error {
+		for _, value := range page.Values {
+			var number int
+			err := json.Unmarshal(value.ID, &number)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, backportCandidate{number: number, closed: value.State == "DECLINED"})
+		}
+		return nil
+	})
+	return candidates, err
+}
+
+func (s *scmImpl) stashPages(path string, params url.Values, fn func(page *stashPage) error) error {
+	params.Set("limit", fmt.Sprint(stashPageSize))
+	for {
+		req := &scm.Request{Method: "GET", Path: fmt.Sprintf("%s?%s", path, params.Encode())}
+		resp, err := s.client.Do(context.Background(), req)
+		if err != nil {
+			return err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.Status != http.StatusOK {
+			return fmt.Errorf("unable to get %s: %d %s", path, resp.Status, body)
+		}
+
+		page := &stashPage{}
+		err = json.Unmarshal(body, page)
+		if err != nil {
+			return err
+		}
+
+		err = fn(page)
+		if err != nil {
+			return err
+		}
+
+		if page.IsLastPage || len(page.Values) == 0 {
+			return nil
+		}
+		params.Set("start", fmt.Sprint(page.NextPageStart))
+	}
+}
@@ -0,0 +1,56 @@
+package service_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitbucketServer(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/api/1.0/projects/PRJ/repos/repo/pull-requests/1/commits", func(w http.ResponseWriter, r *http.Request) {
+		// two pages, newest commit first
+		if r.URL.Query().Get("start") == "" {
+			fmt.Fprint(w, `{"values":[{"id":"ccc"},{"id":"bbb"}],"isLastPage":false,"nextPageStart":2}`)
+			return
+		}
+		fmt.Fprint(w, `{"values":[{"id":"aaa"}],"isLastPage":true}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PRJ/repos/repo/pull-requests/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":1,"state":"MERGED","fromRef":{"displayId":"fix"},"toRef":{"displayId":"main"}}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PRJ/repos/repo/pull-requests", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("at") == "refs/heads/backport-PR-1-to-1.x" && r.URL.Query().Get("state") == "ALL" {
+			fmt.Fprint(w, `{"values":[{"id":7}],"isLastPage":true}`)
+			return
+		}
+		fmt.Fprint(w, `{"values":[],"isLastPage":true}`)
+	})
+	mux.HandleFunc("/rest/api/1.0/projects/PRJ/repos/repo/pull-requests/7", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":7,"state":"OPEN","fromRef":{"displayId":"backport-PR-1-to-1.x"},"toRef":{"displayId":"1.x"},"links":{"self":[{"href":"https://bitbucket.example.com/projects/PRJ/repos/repo/pull-requests/7"}]}}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s := service.NewScm(service.Server{Driver: service.DriverBitbucketServer, URL: server.URL}, "backport", "token")
+
+	commits, err := s.ListCommitsForPr("PRJ", "repo", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaa", "bbb", "ccc"}, commits)
+
+	backport, err := s.FindBackportPr("PRJ", "repo", 1, "1.x", service.BackportOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, backport)
+	assert.Equal(t, 7, backport.Number)
+	assert.Equal(t, "https://bitbucket.example.com/projects/PRJ/repos/repo/pull-requests/7", backport.Link)
+
+	backport, err = s.FindBackportPr("PRJ", "repo", 1, "2.x", service.BackportOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, backport)
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+)
+
+// The templates used unless $BACKPORT_BRANCH_TEMPLATE, $BACKPORT_TITLE_TEMPLATE,
+// $BACKPORT_BODY_TEMPLATE or $BACKPORT_TRAILERS are set.
+const (
+	DefaultBranchTemplate = "backport-PR-{{.PR.Number}}-to-{{.Branch}}"
+	DefaultTitleTemplate  = "[{{.Branch}}] {{.PR.Title}}"
+	DefaultBodyTemplate   = "Backport from {{.PR.Link}}{{with .PR.Body}}\n\n{{.}}{{end}}"
+)
+
+// The title and body of a backport PR that does not copy the title or body of its
+// source PR.
+const (
+	uncopiedTitleTemplate = "Backporting PR-{{.PR.Number}} to {{.Branch}}"
+	uncopiedBodyTemplate  = "Backport from {{.PR.Link}}"
+)
+
+// DefaultTrailers are added to each backported commit unless $BACKPORT_TRAILERS is set.
+var DefaultTrailers = []string{BackportOfTrailer + ": {{.Owner}}/{{.Repo}}#{{.PR.Number}}"}
+
+// DefaultTemplates are used when the options have no templates.
+var DefaultTemplates = mustParseTemplates(DefaultBranchTemplate, DefaultTitleTemplate, DefaultBodyTemplate, DefaultTrailers)
+
+var uncopiedTemplates = mustParseTemplates(DefaultBranchTemplate, uncopiedTitleTemplate, uncopiedBodyTemplate, nil)
+
+// TemplateData is what the templates are executed with.
+type TemplateData struct {
+	Owner string
+	Repo  string
+	// PR is the source PR that is being backported.
+	PR *scm.PullRequest
+	// Branch is the branch the PR is being backported to.
+	Branch string
+	// Commits are the commits of the PR.
+	Commits []string
+	// Author is the author of the PR.
+	Author scm.User
+}
+
+func newTemplateData(owner string, repo string, source *scm.PullRequest, branch string, commits []string) TemplateData {
+	return TemplateData{
+		Owner:   owner,
+		Repo:    repo,
+		PR:      source,
+		Branch:  branch,
+		Commits: commits,
+		Author:  source.Author,
+	}
+}
+
+// Templates render the backport branch name, the title and body of the backport PR
+// and the trailers added to each backported commit.
+type Templates struct {
+	Branch   *template.Template
+	Title    *template.Template
+	Body     *template.Template
+	Trailers []*template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"join":    strings.Join,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+	"short": func(sha string) string {
+		if len(sha) > 7 {
+			return sha[:7]
+		}
+		return sha
+	},
+}
+
+// sampleData is used to check that the templates can be executed.
+var sampleData = TemplateData{
+	Owner: "owner",
+	Repo:  "repo",
+	PR: &scm.PullRequest{
+		Number: 1,
+		Title:  "title",
+		Body:   "body",
+		Link:   "https://example.com/owner/repo/pull/1",
+		Author: scm.User{Login: "author"},
+	},
+	Branch:  "1.x",
+	Commits: []string{"0123456789abcdef0123456789abcdef01234567"},
+	Author:  scm.User{Login: "author"},
+}
+
+// ParseTemplates parses the templates and checks that they can be executed, and
+// that the branch template renders a valid branch name.
+func ParseTemplates(branch string, title string, body string, trailers []string) (*Templates, error) {
+	var err error
+	t := &Templates{}
+
+	t.Branch, err = parseBranchTemplate(branch)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Title, err = parseTemplate("title", title)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Body, err = parseTemplate("body", body)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Trailers, err = parseTrailerTemplates(trailers)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Override returns a copy of the templates with those that are given replaced, a
+// nil trailers keeps the trailers.
+func (t *Templates) Override(branch string, title string, body string, trailers *[]string) (*Templates, error) {
+	var err error
+	o := *t
+
+	if branch != "" {
+		o.Branch, err = parseBranchTemplate(branch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if title != "" {
+		o.Title, err = parseTemplate("title", title)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if body != "" {
+		o.Body, err = parseTemplate("body", body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if trailers != nil {
+		o.Trailers, err = parseTrailerTemplates(*trailers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &o, nil
+}
+
+// forCopy returns the templates of a backport PR that copies fields of its source PR,
+// the title and body it does not copy are replaced with ones that only link to it.
+func (t *Templates) forCopy(fields []string) *Templates {
+	o := *t
+	if !contains(fields, CopyTitle) {
+		o.Title = uncopiedTemplates.Title
+	}
+	if !contains(fields, CopyBody) {
+		o.Body = uncopiedTemplates.Body
+	}
+	return &o
+}
+
+// parseBranchTemplate parses the branch template, the branch name is checked by git
+// itself when the backport is pushed, but a template that can never give a valid
+// name is rejected up front.
+func parseBranchTemplate(text string) (*template.Template, error) {
+	tmpl, err := parseTemplate("branch", text)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := render(tmpl, sampleData)
+	if err != nil {
+		return nil, err
+	}
+	if name = strings.TrimSpace(name); !validBranchName(name) {
+		return nil, fmt.Errorf("invalid branch template %q: %q is not a valid branch name", text, name)
+	}
+	return tmpl, nil
+}
+
+func parseTrailerTemplates(trailers []string) ([]*template.Template, error) {
+	var templates []*template.Template
+	for i, trailer := range trailers {
+		tmpl, err := parseTemplate(fmt.Sprintf("trailer %d", i+1), trailer)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template %q: %w", name, text, err)
+	}
+
+	_, err = render(tmpl, sampleData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template %q: %w", name, text, err)
+	}
+	return tmpl, nil
+}
+
+func mustParseTemplates(branch string, title string, body string, trailers []string) *Templates {
+	t, err := ParseTemplates(branch, title, body, trailers)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// TemplatesFromEnv parses the templates from $BACKPORT_BRANCH_TEMPLATE,
+// $BACKPORT_TITLE_TEMPLATE, $BACKPORT_BODY_TEMPLATE and the comma separated
+// $BACKPORT_TRAILERS, an empty $BACKPORT_TRAILERS disables the trailers.
+func TemplatesFromEnv() (*Templates, error) {
+	return ParseTemplates(
+		envOrDefault("BACKPORT_BRANCH_TEMPLATE", DefaultBranchTemplate),
+		titleFromEnv(),
+		envOrDefault("BACKPORT_BODY_TEMPLATE", DefaultBodyTemplate),
+		trailersFromEnv(),
+	)
+}
+
+// titleFromEnv reads the title template from $BACKPORT_TITLE_TEMPLATE, or else
+// prepends the older $BACKPORT_TITLE_PREFIX to the title of the PR.
+func titleFromEnv() string {
+	if s := os.Getenv("BACKPORT_TITLE_TEMPLATE"); s != "" {
+		return s
+	}
+	if s, ok := os.LookupEnv("BACKPORT_TITLE_PREFIX"); ok {
+		logrus.Warn("BACKPORT_TITLE_PREFIX is deprecated, use BACKPORT_TITLE_TEMPLATE")
+		return legacyTemplate(s) + "{{.PR.Title}}"
+	}
+	return DefaultTitleTemplate
+}
+
+// legacyTemplate turns the ${owner}, ${repo}, ${pr} and ${branch} placeholders used
+// before the templates into their actions.
+func legacyTemplate(s string) string {
+	return strings.NewReplacer(
+		"${owner}", "{{.Owner}}",
+		"${repo}", "{{.Repo}}",
+		"${pr}", "{{.PR.Number}}",
+		"${branch}", "{{.Branch}}",
+	).Replace(s)
+}
+
+func envOrDefault(name string, value string) string {
+	if s := os.Getenv(name); s != "" {
+		return s
+	}
+	return value
+}
+
+// BranchName renders the name of the branch used to backport the PR.
+func (t *Templates) BranchName(data TemplateData) (string, error) {
+	name, err := render(t.Branch, data)
+	return strings.TrimSpace(name), err
+}
+
+// PullRequestInput renders the backport PR.
+func (t *Templates) PullRequestInput(data TemplateData) (scm.PullRequestInput, error) {
+	head, err := t.BranchName(data)
+	if err != nil {
+		return scm.PullRequestInput{}, err
+	}
+
+	title, err := render(t.Title, data)
+	if err != nil {
+		return scm.PullRequestInput{}, err
+	}
+
+	body, err := render(t.Body, data)
+	if err != nil {
+		return scm.PullRequestInput{}, err
+	}
+
+	return scm.PullRequestInput{
+		Title: strings.TrimSpace(title),
+		Head:  head,
+		Base:  data.Branch,
+		Body:  body,
+	}, nil
+}
+
+// RenderTrailers renders the trailers, leaving out any that are empty.
+func (t *Templates) RenderTrailers(data TemplateData) ([]string, error) {
+	var trailers []string
+	for _, tmpl := range t.Trailers {
+		trailer, err := render(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		if trailer = strings.TrimSpace(trailer); trailer != "" {
+			trailers = append(trailers, trailer)
+		}
+	}
+	return trailers, nil
+}
+
+func render(tmpl *template.Template, data TemplateData) (string, error) {
+	var sb strings.Builder
+	err := tmpl.Execute(&sb, data)
+	return sb.String(), err
+}
+
+// validBranchName loosely follows git check-ref-format.
+func validBranchName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "-") || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") ||
+		strings.HasSuffix(name, ".") || strings.HasSuffix(name, ".lock") {
+		return false
+	}
+	for _, s := range []string{"..", "//", "@{", " ", "~", "^", ":", "?", "*", "[", "\\", "\t", "\n"} {
+		if strings.Contains(name, s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTemplates(t *testing.T) {
+	type test struct {
+		name          string
+		branch        string
+		title         string
+		body          string
+		trailers      []string
+		expectedError string
+	}
+
+	tests := []test{
+		{
+			name:     "defaults",
+			branch:   service.DefaultBranchTemplate,
+			title:    service.DefaultTitleTemplate,
+			body:     service.DefaultBodyTemplate,
+			trailers: service.DefaultTrailers,
+		},
+		{
+			name:     "functions",
+			branch:   "{{.Author.Login}}/{{.Branch}}/{{short (index .Commits 0)}}",
+			title:    "{{upper .Branch}}: {{.PR.Title}}",
+			body:     "Backports {{join .Commits \", \"}}",
+			trailers: []string{"Reviewed-By: {{lower .Author.Login}}"},
+		},
+		{
+			name:          "unparseable",
+			branch:        service.DefaultBranchTemplate,
+			title:         "{{.PR.Title",
+			body:          service.DefaultBodyTemplate,
+			expectedError: `invalid title template "{{.PR.Title": template: title:1: unclosed action`,
+		},
+		{
+			name:          "unknown field",
+			branch:        service.DefaultBranchTemplate,
+			title:         service.DefaultTitleTemplate,
+			body:          "{{.PR.Description}}",
+			expectedError: `invalid body template "{{.PR.Description}}": template: body:1:5: executing "body" at <.PR.Description>: can't evaluate field Description in type *scm.PullRequest`,
+		},
+		{
+			name:          "invalid branch name",
+			branch:        "backport {{.PR.Number}}",
+			title:         service.DefaultTitleTemplate,
+			body:          service.DefaultBodyTemplate,
+			expectedError: `invalid branch template "backport {{.PR.Number}}": "backport 1" is not a valid branch name`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := service.ParseTemplates(test.branch, test.title, test.body, test.trailers)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	templates, err := service.ParseTemplates(
+		"{{.Branch}}/backport-{{.PR.Number}}",
+		"[{{.Branch}}] {{.PR.Title}} (#{{.PR.Number}})",
+		"Backport of {{.PR.Link}} by @{{.Author.Login}}",
+		[]string{"Backport-Of: {{.Owner}}/{{.Repo}}#{{.PR.Number}}", "{{if gt (len .Commits) 1}}Squashed: true{{end}}"},
+	)
+	require.NoError(t, err)
+
+	data := service.TemplateData{
+		Owner: "org",
+		Repo:  "repo",
+		PR: &scm.PullRequest{
+			Number: 12,
+			Title:  "Fix a bug",
+			Link:   "https://github.com/org/repo/pull/12",
+		},
+		Branch:  "1.x",
+		Commits: []string{"abc123"},
+		Author:  scm.User{Login: "alice"},
+	}
+
+	input, err := templates.PullRequestInput(data)
+	require.NoError(t, err)
+	assert.Equal(t, scm.PullRequestInput{
+		Title: "[1.x] Fix a bug (#12)",
+		Head:  "1.x/backport-12",
+		Base:  "1.x",
+		Body:  "Backport of https://github.com/org/repo/pull/12 by @alice",
+	}, input)
+
+	// empty trailers are left out
+	trailers, err := templates.RenderTrailers(data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Backport-Of: org/repo#12"}, trailers)
+}
+
+func TestTemplatesFromEnv(t *testing.T) {
+	type test struct {
+		name             string
+		env              map[string]string
+		expectedTitle    string
+		expectedTrailers []string
+	}
+
+	tests := []test{
+		{
+			name:             "defaults",
+			expectedTitle:    "[1.x] Fix a bug",
+			expectedTrailers: []string{"Backport-Of: org/repo#12"},
+		},
+		{
+			name:             "title template",
+			env:              map[string]string{"BACKPORT_TITLE_TEMPLATE": "{{.PR.Title}} ({{.Branch}})", "BACKPORT_TITLE_PREFIX": "Backport: "},
+			expectedTitle:    "Fix a bug (1.x)",
+			expectedTrailers: []string{"Backport-Of: org/repo#12"},
+		},
+		{
+			name:             "title prefix from before the templates",
+			env:              map[string]string{"BACKPORT_TITLE_PREFIX": "Backport ${pr} to ${branch}: "},
+			expectedTitle:    "Backport 12 to 1.x: Fix a bug",
+			expectedTrailers: []string{"Backport-Of: org/repo#12"},
+		},
+		{
+			name:             "empty title prefix",
+			env:              map[string]string{"BACKPORT_TITLE_PREFIX": ""},
+			expectedTitle:    "Fix a bug",
+			expectedTrailers: []string{"Backport-Of: org/repo#12"},
+		},
+		{
+			name:             "trailers from before the templates",
+			env:              map[string]string{"BACKPORT_TRAILERS": "Backport-Of: ${owner}/${repo}#${pr}, Backport-Branch: {{.Branch}}"},
+			expectedTitle:    "[1.x] Fix a bug",
+			expectedTrailers: []string{"Backport-Of: org/repo#12", "Backport-Branch: 1.x"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			templates, err := service.TemplatesFromEnv()
+			require.NoError(t, err)
+
+			data := service.TemplateData{
+				Owner:  "org",
+				Repo:   "repo",
+				PR:     &scm.PullRequest{Number: 12, Title: "Fix a bug"},
+				Branch: "1.x",
+			}
+
+			input, err := templates.PullRequestInput(data)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedTitle, input.Title)
+
+			trailers, err := templates.RenderTrailers(data)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedTrailers, trailers)
+		})
+	}
+}
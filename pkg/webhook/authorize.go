@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/sirupsen/logrus"
+)
+
+// authorized reports whether the user can request backports of the repository's PRs,
+// either having the minimum permission on the repository or being in one of the teams.
+func authorized(l *logrus.Entry, s service.Scm, owner string, repo string, user string, a service.Authorization) (bool, error) {
+	if user == "" {
+		return false, nil
+	}
+
+	permission, err := s.FindUserPermission(owner, repo, user)
+	if err != nil {
+		return false, err
+	}
+	if a.HasPermission(permission) {
+		return true, nil
+	}
+
+	for _, team := range a.Teams {
+		member, err := s.IsTeamMember(team, user)
+		if err != nil {
+			// a team that cannot be checked does not stop the others being checked
+			l.Warnf("unable to check whether %s is a member of %s: %v", user, team, err)
+			continue
+		}
+		if member {
+			return true, nil
+		}
+	}
+
+	l.Infof("%s has %s permission on %s/%s, which is not enough to request backports", user, permission, owner, repo)
+	return false, nil
+}
+
+// refusal is the comment made when the user cannot request backports.
+func refusal(user string, a service.Authorization) string {
+	who := fmt.Sprintf("users with %s permission on this repository", a.MinPermission())
+	if len(a.Teams) > 0 {
+		who = fmt.Sprintf("%s or members of %s", who, strings.Join(a.Teams, ", "))
+	}
+	return fmt.Sprintf("Sorry @%s, backports can only be requested by %s.", user, who)
+}
@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Backports lists the upstream PRs that have been backported to the branch given
+// by the branch query parameter of the repository given by the repo parameter, as
+// owner/name. The server is the one configured by $GIT_KIND and $GIT_SERVER, a
+// github app authenticates as the installation given by the installation parameter.
+// The branch is read with the server's credentials, so it is served behind
+// Authenticated.
+func (o *Controller) Backports(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	branch := query.Get("branch")
+	i := strings.LastIndex(query.Get("repo"), "/")
+	if i <= 0 || branch == "" {
+		responseHTTPError(w, http.StatusBadRequest, "400 Bad Request: repo and branch are required")
+		return
+	}
+	owner, repo := query.Get("repo")[:i], query.Get("repo")[i+1:]
+
+	server := ServerForRequest(r, nil)
+	if s := query.Get("installation"); s != "" {
+		installation, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			responseHTTPError(w, http.StatusBadRequest, "400 Bad Request: invalid installation")
+			return
+		}
+		server.Installation = installation
+	}
+
+	l := logrus.WithFields(logrus.Fields{
+		"Repo":   fmt.Sprintf("%s/%s", owner, repo),
+		"Branch": branch,
+	})
+
+	s, err := o.scm(l, server)
+	if err != nil {
+		responseHTTPError(w, http.StatusInternalServerError, fmt.Sprintf("500 Internal Server Error: %s", err.Error()))
+		return
+	}
+
+	backports, err := s.ListBackportsToBranch(owner, repo, branch)
+	if err != nil {
+		l.Errorf("unable to list the backports: %v", err)
+		responseHTTPError(w, http.StatusInternalServerError, fmt.Sprintf("500 Internal Server Error: %s", err.Error()))
+		return
+	}
+
+	writeJSON(w, backports)
+}
@@ -0,0 +1,65 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackports(t *testing.T) {
+	type test struct {
+		name     string
+		query    string
+		status   int
+		expected []service.Backport
+	}
+
+	backported := []service.Backport{{PR: "org/repo#1", Commits: []string{"abc123"}}}
+
+	tests := []test{
+		{
+			name:     "lists the backports to the branch",
+			query:    "repo=org/repo&branch=1.x",
+			status:   http.StatusOK,
+			expected: backported,
+		},
+		{
+			name:   "requires the branch",
+			query:  "repo=org/repo",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "requires the owner",
+			query:  "repo=repo&branch=1.x",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeScm{backported: map[string][]service.Backport{"1.x": backported}}
+			c := &webhook.Controller{
+				ScmFactory: func(server service.Server) (service.Scm, error) {
+					return s, nil
+				},
+			}
+
+			w := httptest.NewRecorder()
+			c.Backports(w, httptest.NewRequest(http.MethodGet, "/backports?"+test.query, nil))
+			assert.Equal(t, test.status, w.Code)
+
+			if test.expected != nil {
+				var backports []service.Backport
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &backports))
+				assert.Equal(t, test.expected, backports)
+			}
+		})
+	}
+}
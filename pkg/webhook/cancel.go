@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cancelBackports handles the /backport cancel and /unbackport commands in the
+// comment. The request for each branch is withdrawn and its job dropped if it has not
+// run yet, and when the options ask for it the backport PR is closed. A backport that
+// is already in progress carries on.
+func (o *Controller) cancelBackports(l *logrus.Entry, server service.Server, s service.Scm, owner string, repo string, pr int, body string, config *service.RepoConfig, opts service.BackportOptions) error {
+	commands, _ := parseCommands(body)
+	commands = commandsWithAction(commands, actionCancel)
+	if len(commands) == 0 {
+		return nil
+	}
+
+	requested, err := s.DetermineBranchesForPr(owner, repo, pr, config.Prefix())
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	for _, c := range commands {
+		args = append(args, c.args...)
+	}
+	branches, messages := matchRequested(args, requested, actionCancel)
+
+	var statuses []branchStatus
+	for _, branch := range branches {
+		// a backport that is in progress carries on, so it is left requested
+		running := false
+		if o.Queue != nil {
+			job, cancelled := o.Queue.Cancel(server, owner, repo, pr, branch)
+			if cancelled {
+				l.Infof("cancelled the backport of PR-%d to %s in job %d", pr, branch, job.ID)
+			}
+			running = job.Status == queue.StatusRunning
+		} else {
+			job := queue.Job{Server: server, Owner: owner, Repo: repo, PR: pr, Branch: branch}
+			_, running = o.inflight.Load(job.Key())
+		}
+		if running {
+			messages = append(messages, fmt.Sprintf("The backport to %s is already in progress and cannot be cancelled", branch))
+			continue
+		}
+
+		err := s.RemoveBackportBranchFromPr(owner, repo, pr, branch, config.Prefix())
+		if err != nil {
+			return err
+		}
+
+		st, err := cancelled(s, owner, repo, pr, branch, opts)
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, st)
+	}
+
+	for _, message := range messages {
+		err := s.AddCommentToPr(owner, repo, pr, message)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(statuses) > 0 {
+		o.setStatus(l, s, owner, repo, pr, statuses...)
+	}
+	return nil
+}
+
+// cancelled returns the status of a cancelled backport, closing its backport PR if
+// there is one and the options ask for it.
+func cancelled(s service.Scm, owner string, repo string, pr int, branch string, opts service.BackportOptions) (branchStatus, error) {
+	st := branchStatus{Branch: branch, State: stateCancelled}
+
+	existing, err := s.FindBackportPr(owner, repo, pr, branch, opts)
+	if err != nil || existing == nil {
+		return st, err
+	}
+	st.Result = service.BackportResult{Branch: branch, Number: existing.Number, Link: existing.Link}
+
+	if opts.CloseCancelled && !existing.Closed && !existing.Merged {
+		err := s.ClosePr(owner, repo, existing.Number)
+		if err != nil {
+			return st, err
+		}
+		st.Closed = true
+	}
+	return st, nil
+}
@@ -0,0 +1,236 @@
+package webhook_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelBackports(t *testing.T) {
+	type test struct {
+		name             string
+		body             string
+		config           string
+		backports        map[string]int
+		expectedRemoved  []string
+		expectedClosed   []int
+		expectedComments []string
+	}
+
+	tests := []test{
+		{
+			name:            "cancel a requested branch",
+			body:            "/backport cancel 1.1.x",
+			expectedRemoved: []string{"Backport to 1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Cancelled |\n",
+			},
+		},
+		{
+			name:            "unbackport the branches matching a pattern",
+			body:            "/unbackport 1.*",
+			expectedRemoved: []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Cancelled |\n| `1.2.x` | Cancelled |\n",
+			},
+		},
+		{
+			name:            "backport PR is left open",
+			body:            "/backport cancel 1.2.x",
+			backports:       map[string]int{"1.2.x": 12},
+			expectedRemoved: []string{"Backport to 1.2.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.2.x` | Cancelled, PR https://github.com/org/repo/pull/12 was not closed |\n",
+			},
+		},
+		{
+			name:            "backport PR is closed",
+			body:            "/backport cancel 1.2.x",
+			config:          "closeCancelled: true\n",
+			backports:       map[string]int{"1.2.x": 12},
+			expectedRemoved: []string{"Backport to 1.2.x"},
+			expectedClosed:  []int{12},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.2.x` | Cancelled, closed PR https://github.com/org/repo/pull/12 |\n",
+			},
+		},
+		{
+			name:             "branch that was not requested",
+			body:             "/backport cancel 1.3.x",
+			expectedComments: []string{"Unable to cancel the backport to 1.3.x, it has not been requested"},
+		},
+		{
+			name:             "no branches",
+			body:             "/backport cancel",
+			expectedComments: []string{"Unable to parse `/backport cancel`, expected the branches to cancel the backports to, e.g. `/backport cancel 1.x`"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeScm{
+				branches:  []string{"main", "1.1.x", "1.2.x", "1.3.x"},
+				labels:    []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+				merged:    true,
+				config:    []byte(test.config),
+				backports: test.backports,
+			}
+			c := &webhook.Controller{
+				ScmFactory: func(server service.Server) (service.Scm, error) {
+					return s, nil
+				},
+			}
+
+			err := c.HandleComment(logrus.WithField("test", t.Name()), githubServer, "org", "repo", "octocat", test.body, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedRemoved, s.removedLabels)
+			assert.Equal(t, test.expectedClosed, s.closed)
+			assert.Empty(t, s.addedLabels)
+			assert.Empty(t, s.applied)
+			assert.Equal(t, test.expectedComments, visible(s.comments))
+		})
+	}
+}
+
+func TestCancelQueuedBackport(t *testing.T) {
+	s := &fakeScm{
+		branches: []string{"main", "1.1.x", "1.2.x"},
+		labels:   []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+		merged:   true,
+		commits:  []string{"abc123"},
+		block:    make(chan struct{}),
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+	c.Queue = queue.New(c.RunJob, queue.Options{Workers: 1, MaxAttempts: 1})
+	require.NoError(t, c.Queue.Start())
+	defer c.Queue.Stop()
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	l := logrus.WithField("test", t.Name())
+	_, _, err := c.ProcessWebHook(l, githubServer, w)
+	require.NoError(t, err)
+
+	// one backport is held up in progress while the other waits for the worker
+	var running, pending string
+	require.Eventually(t, func() bool {
+		for _, job := range c.Queue.List() {
+			switch job.Status {
+			case queue.StatusRunning:
+				running = job.Branch
+			case queue.StatusPending:
+				pending = job.Branch
+			}
+		}
+		return running != "" && pending != ""
+	}, 5*time.Second, time.Millisecond)
+
+	err = c.HandleComment(l, githubServer, "org", "repo", "octocat", "/unbackport 1.1.x 1.2.x", 1)
+	assert.NoError(t, err)
+	close(s.block)
+
+	expected := "| Branch | Status |\n| --- | --- |\n"
+	for _, branch := range []string{"1.1.x", "1.2.x"} {
+		if branch == running {
+			expected += fmt.Sprintf("| `%s` | Created PR https://github.com/org/repo/pull/20 |\n", branch)
+		} else {
+			expected += fmt.Sprintf("| `%s` | Cancelled |\n", branch)
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.comments) == 2 && visible(s.comments)[0] == expected
+	}, 5*time.Second, time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []string{running}, s.applied)
+	// the backport in progress is still requested
+	assert.Equal(t, []string{"Backport to " + pending}, s.removedLabels)
+	assert.Equal(t, fmt.Sprintf("The backport to %s is already in progress and cannot be cancelled", running), s.comments[1])
+}
+
+func TestCancelRunningBackportWithoutQueue(t *testing.T) {
+	release := make(chan struct{})
+	s := &fakeScm{
+		branches: []string{"main", "1.1.x"},
+		labels:   []string{"Backport to 1.1.x"},
+		merged:   true,
+		commits:  []string{"abc123"},
+		block:    release,
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	l := logrus.WithField("test", t.Name())
+	done := make(chan error)
+	go func() {
+		_, _, err := c.ProcessWebHook(l, githubServer, w)
+		done <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.comments) == 1 && strings.Contains(s.comments[0], "In progress")
+	}, 5*time.Second, time.Millisecond)
+
+	err := c.HandleComment(l, githubServer, "org", "repo", "octocat", "/unbackport 1.1.x", 1)
+	assert.NoError(t, err)
+
+	close(release)
+	assert.NoError(t, <-done)
+
+	// the backport in progress carries on and is still requested
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Empty(t, s.removedLabels)
+	assert.Equal(t, []string{"1.1.x"}, s.applied)
+	assert.Equal(t, []string{
+		"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+		"The backport to 1.1.x is already in progress and cannot be cancelled",
+	}, visible(s.comments))
+}
@@ -0,0 +1,183 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// commandPrefix starts each backport command in a comment, unbackportCommand is
+// short for /backport cancel.
+const (
+	commandPrefix     = "/backport"
+	unbackportCommand = "/unbackport"
+)
+
+// allSupported requests a backport to every branch the repository's configuration
+// allows.
+const allSupported = "all-supported"
+
+// the actions a command can take, the branches are backported to when it has none.
+const (
+	actionBackport = ""
+	actionCancel   = "cancel"
+	actionRetry    = "retry"
+	actionStatus   = "status"
+)
+
+// command is a /backport command in a comment.
+type command struct {
+	action string
+	// args are the branch names and patterns, and all-supported.
+	args []string
+}
+
+// parseCommands returns the /backport commands in the comment, along with a message
+// for each one that cannot be parsed. Commands in quoted replies and in fenced code
+// blocks are ignored, as they are not being asked for by the commenter.
+func parseCommands(body string) ([]command, []string) {
+	var commands []command
+	var messages []string
+
+	fence := ""
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimLeft(line, " ")
+
+		// a fence is closed by another of the same character at least as long
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]+" \t") == "" {
+				fence = ""
+			}
+			continue
+		}
+		if f := openingFence(trimmed); f != "" {
+			fence = f
+			continue
+		}
+
+		// indented by 4 or more is a code block, and > is a quoted reply
+		if len(line)-len(trimmed) >= 4 || strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+
+		name, rest, ok := commandName(trimmed)
+		if !ok {
+			continue
+		}
+
+		c, err := parseCommand(name, rest)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("Unable to parse `%s`, %s", strings.TrimSpace(trimmed), err))
+			continue
+		}
+		commands = append(commands, c)
+	}
+
+	return commands, messages
+}
+
+// openingFence returns the fence that the line opens, if it opens one.
+func openingFence(line string) string {
+	for _, c := range []string{"`", "~"} {
+		n := len(line) - len(strings.TrimLeft(line, c))
+		if n >= 3 {
+			return strings.Repeat(c, n)
+		}
+	}
+	return ""
+}
+
+// commandName splits the line into the command it starts with and the rest of it.
+func commandName(line string) (string, string, bool) {
+	for _, name := range []string{commandPrefix, unbackportCommand} {
+		if !strings.HasPrefix(line, name) {
+			continue
+		}
+		rest := strings.TrimPrefix(line, name)
+		if rest == "" || rest[0] == ' ' || rest[0] == '\t' {
+			return name, rest, true
+		}
+	}
+	return "", "", false
+}
+
+// parseCommand parses the action and arguments of a command, the arguments are
+// separated by spaces or commas.
+func parseCommand(name string, rest string) (command, error) {
+	args := strings.FieldsFunc(rest, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ','
+	})
+
+	c := command{action: actionBackport}
+	if name == unbackportCommand {
+		c.action = actionCancel
+	} else if len(args) > 0 && (args[0] == actionCancel || args[0] == actionRetry || args[0] == actionStatus) {
+		c.action, args = args[0], args[1:]
+	}
+
+	if c.action == actionStatus && len(args) > 0 {
+		return command{}, fmt.Errorf("`%s %s` does not take any branches", commandPrefix, actionStatus)
+	}
+
+	// retry without any branches retries them all
+	if len(args) == 0 {
+		switch c.action {
+		case actionCancel:
+			return command{}, fmt.Errorf("expected the branches to cancel the backports to, e.g. `%s %s 1.x`", commandPrefix, actionCancel)
+		case actionBackport:
+			return command{}, fmt.Errorf("expected the branches to backport to, e.g. `%s 1.x 2.x`", commandPrefix)
+		}
+	}
+
+	for _, arg := range args {
+		if isPattern(arg) {
+			if _, err := path.Match(arg, ""); err != nil {
+				return command{}, fmt.Errorf("`%s` is not a valid branch pattern", arg)
+			}
+		}
+	}
+
+	c.args = args
+	return c, nil
+}
+
+// matchRequested returns the requested branches that the args name or match, with a
+// message for each arg that matches none of them, which explains that the action
+// cannot be taken.
+func matchRequested(args []string, requested []string, action string) ([]string, []string) {
+	var branches []string
+	var messages []string
+	for _, arg := range args {
+		matched := false
+		for _, branch := range requested {
+			if ok, _ := path.Match(arg, branch); ok {
+				matched = true
+				if !contains(branches, branch) {
+					branches = append(branches, branch)
+				}
+			}
+		}
+		if !matched {
+			messages = append(messages, fmt.Sprintf("Unable to %s the backport to %s, it has not been requested", action, arg))
+		}
+	}
+	return branches, messages
+}
+
+// commandsWithAction returns the commands that take the action.
+func commandsWithAction(commands []command, action string) []command {
+	var matching []command
+	for _, c := range commands {
+		if c.action == action {
+			matching = append(matching, c)
+		}
+	}
+	return matching
+}
+
+// isPattern reports whether the argument is a pattern, as for path.Match, rather than
+// a branch name. None of the pattern characters are allowed in a branch name.
+func isPattern(arg string) bool {
+	return strings.ContainsAny(arg, "*?[")
+}
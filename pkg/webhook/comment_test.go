@@ -0,0 +1,375 @@
+package webhook_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleComment(t *testing.T) {
+	type test struct {
+		name             string
+		body             string
+		merged           bool
+		config           string
+		approvals        int
+		permission       string
+		teams            []string
+		authorization    service.Authorization
+		existingLabels   []string
+		expectedLabels   []string
+		expectedBackport []string
+		expectedComments []string
+	}
+
+	tests := []test{
+		{
+			name:           "open PR only adds labels",
+			body:           "/backport 1.1.x",
+			expectedLabels: []string{"Backport to 1.1.x"},
+		},
+		{
+			name:             "merged PR backports immediately",
+			body:             "/backport 1.1.x",
+			merged:           true,
+			expectedLabels:   []string{"Backport to 1.1.x"},
+			expectedBackport: []string{"1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:             "merged PR only backports newly requested branches",
+			body:             "/backport 1.1.x\n/backport 1.2.x",
+			merged:           true,
+			existingLabels:   []string{"Backport to 1.1.x"},
+			expectedLabels:   []string{"Backport to 1.2.x"},
+			expectedBackport: []string{"1.2.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.2.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:             "merged PR with unknown branch",
+			body:             "/backport 1.3.x",
+			merged:           true,
+			expectedComments: []string{"Unable to locate branch 1.3.x"},
+		},
+		{
+			name:             "invalid configuration",
+			body:             "/backport 1.1.x",
+			merged:           true,
+			config:           "conflicts: maybe\n",
+			expectedComments: []string{`Unable to backport, .github/backport.yml is invalid: invalid conflicts "maybe", expected fail or draft`},
+		},
+		{
+			name:             "invalid configuration and commenter without write permission",
+			body:             "/backport 1.1.x",
+			merged:           true,
+			config:           "conflicts: maybe\n",
+			permission:       "read",
+			expectedComments: []string{"Sorry @octocat, backports can only be requested by users with write permission on this repository."},
+		},
+		{
+			name:             "branch not allowed by the configuration",
+			body:             "/backport main",
+			merged:           true,
+			config:           "branches: [\"1.*\"]\n",
+			expectedComments: []string{"Backporting to main is not allowed by .github/backport.yml"},
+		},
+		{
+			name:             "label prefix from the configuration",
+			body:             "/backport 1.1.x",
+			merged:           true,
+			config:           "labelPrefix: backport/\n",
+			existingLabels:   []string{"Backport to 1.1.x"},
+			expectedLabels:   []string{"backport/1.1.x"},
+			expectedBackport: []string{"1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:           "merged PR without the required approvals",
+			body:           "/backport 1.1.x",
+			merged:         true,
+			config:         "requiredApprovals: 2\n",
+			approvals:      1,
+			expectedLabels: []string{"Backport to 1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Failed: PR-1 needs 2 approvals to be backported, it has 1 |\n",
+			},
+		},
+		{
+			name:             "merged PR with the required approvals",
+			body:             "/backport 1.1.x",
+			merged:           true,
+			config:           "requiredApprovals: 2\n",
+			approvals:        2,
+			expectedLabels:   []string{"Backport to 1.1.x"},
+			expectedBackport: []string{"1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:             "commenter without write permission",
+			body:             "/backport 1.1.x",
+			merged:           true,
+			permission:       "read",
+			expectedComments: []string{"Sorry @octocat, backports can only be requested by users with write permission on this repository."},
+		},
+		{
+			name:             "commenter in an allowed team",
+			body:             "/backport 1.1.x",
+			merged:           true,
+			permission:       "read",
+			teams:            []string{"org/release"},
+			authorization:    service.Authorization{Teams: []string{"org/maintainers", "org/release"}},
+			expectedLabels:   []string{"Backport to 1.1.x"},
+			expectedBackport: []string{"1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:          "commenter without the permission the repository requires",
+			body:          "/backport 1.1.x",
+			config:        "permission: admin\n",
+			authorization: service.Authorization{Teams: []string{"org/release"}},
+			expectedComments: []string{
+				"Sorry @octocat, backports can only be requested by users with admin permission on this repository or members of org/release.",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeScm{
+				branches:   []string{"main", "1.1.x", "1.2.x"},
+				labels:     test.existingLabels,
+				merged:     test.merged,
+				commits:    []string{"abc123"},
+				config:     []byte(test.config),
+				approvals:  test.approvals,
+				permission: test.permission,
+				teams:      test.teams,
+			}
+			c := &webhook.Controller{
+				ScmFactory: func(server service.Server) (service.Scm, error) {
+					return s, nil
+				},
+				Authorization: test.authorization,
+			}
+
+			err := c.HandleComment(logrus.WithField("test", t.Name()), githubServer, "org", "repo", "octocat", test.body, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedLabels, s.addedLabels)
+			assert.Equal(t, test.expectedBackport, s.applied)
+			assert.Equal(t, test.expectedComments, visible(s.comments))
+		})
+	}
+}
+
+type fakeScm struct {
+	branches []string
+	labels   []string
+	merged   bool
+	commits  []string
+	// backports maps a branch to the number of its existing backport PR
+	backports map[string]int
+	// closedBackports maps a branch to the number of its backport PR that was closed
+	// without being merged
+	closedBackports map[string]int
+	// backported maps a branch to the PRs that have been backported to it
+	backported map[string][]service.Backport
+
+	// failures maps a branch to the error backporting to it fails with
+	failures map[string]error
+	// failureLog, when set, is the git output of the backports that fail
+	failureLog string
+	// block, when set, holds up the backports until it is closed
+	block chan struct{}
+	// config is the content of the repository's .github/backport.yml
+	config []byte
+	// approvals is the number of approvals of the PR
+	approvals int
+	// permission is the commenter's permission on the repository, write when empty
+	permission string
+	// teams are the teams the commenter is a member of
+	teams []string
+
+	mu            sync.Mutex
+	addedLabels   []string
+	removedLabels []string
+	closed        []int
+	applied       []string
+	comments      []string
+	// edits counts the times a comment was edited
+	edits int
+	// editFailure, when set, is the error editing a comment fails with
+	editFailure error
+}
+
+func (f *fakeScm) ListCommitsForPr(owner string, repo string, pr int) ([]string, error) {
+	return f.commits, nil
+}
+
+func (f *fakeScm) DetermineBranchesForPr(owner string, repo string, pr int, prefix string) ([]string, error) {
+	var branches []string
+	for _, label := range f.labels {
+		if strings.HasPrefix(label, prefix) {
+			branches = append(branches, strings.TrimPrefix(label, prefix))
+		}
+	}
+	return branches, nil
+}
+
+func (f *fakeScm) ApplyCommitsToRepo(owner string, repo string, pr int, branch string, commits []string, opts service.BackportOptions) (service.BackportResult, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = append(f.applied, branch)
+	if err := f.failures[branch]; err != nil {
+		log := f.failureLog
+		if log == "" {
+			log = "```\ngit cherry-pick -x abc123\n```"
+		}
+		return service.BackportResult{Branch: branch, Log: log}, err
+	}
+	return service.BackportResult{Branch: branch, Number: 20, Link: fmt.Sprintf("https://github.com/%s/%s/pull/20", owner, repo)}, nil
+}
+
+func (f *fakeScm) ListBranchesForRepo(owner string, repo string) ([]string, error) {
+	return f.branches, nil
+}
+
+func (f *fakeScm) AddCommentToPr(owner string, repo string, pr int, comment string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.comments = append(f.comments, comment)
+	return nil
+}
+
+func (f *fakeScm) FindCommentOnPr(owner string, repo string, pr int, marker string) (int, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, comment := range f.comments {
+		if strings.Contains(comment, marker) {
+			return i + 1, comment, nil
+		}
+	}
+	return 0, "", nil
+}
+
+func (f *fakeScm) EditCommentOnPr(owner string, repo string, pr int, id int, comment string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.editFailure != nil {
+		return f.editFailure
+	}
+	f.comments[id-1] = comment
+	f.edits++
+	return nil
+}
+
+func (f *fakeScm) AddLabelToPr(owner string, repo string, pr int, label string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addedLabels = append(f.addedLabels, label)
+	return nil
+}
+
+func (f *fakeScm) RemoveLabelFromPr(owner string, repo string, pr int, label string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removedLabels = append(f.removedLabels, label)
+	return nil
+}
+
+func (f *fakeScm) RemoveBackportBranchFromPr(owner string, repo string, pr int, branch string, prefix string) error {
+	return f.RemoveLabelFromPr(owner, repo, pr, prefix+branch)
+}
+
+func (f *fakeScm) ClosePr(owner string, repo string, pr int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = append(f.closed, pr)
+	return nil
+}
+
+func (f *fakeScm) FindBackportPr(owner string, repo string, pr int, branch string, opts service.BackportOptions) (*scm.PullRequest, error) {
+	if number, ok := f.backports[branch]; ok {
+		return &scm.PullRequest{Number: number, Link: fmt.Sprintf("https://github.com/%s/%s/pull/%d", owner, repo, number)}, nil
+	}
+	if number, ok := f.closedBackports[branch]; ok {
+		return &scm.PullRequest{Number: number, Link: fmt.Sprintf("https://github.com/%s/%s/pull/%d", owner, repo, number), Closed: true}, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeScm) ListBackportsToBranch(owner string, repo string, branch string) ([]service.Backport, error) {
+	return f.backported[branch], nil
+}
+
+func (f *fakeScm) AddBackportBranchToPr(owner string, repo string, pr int, branch string, prefix string) error {
+	return f.AddLabelToPr(owner, repo, pr, prefix+branch)
+}
+
+func (f *fakeScm) IsPrMerged(owner string, repo string, pr int) (bool, error) {
+	return f.merged, nil
+}
+
+func (f *fakeScm) FindDefaultBranchSha(owner string, repo string) (string, error) {
+	return "sha", nil
+}
+
+func (f *fakeScm) ReadFileFromRepo(owner string, repo string, path string, ref string) ([]byte, error) {
+	return f.config, nil
+}
+
+func (f *fakeScm) CountApprovalsForPr(owner string, repo string, pr int) (int, error) {
+	return f.approvals, nil
+}
+
+func (f *fakeScm) FindUserPermission(owner string, repo string, user string) (string, error) {
+	if f.permission == "" {
+		return scm.WritePermission, nil
+	}
+	return f.permission, nil
+}
+
+func (f *fakeScm) AuthenticatedLogin() (string, error) {
+	return "backport-bot", nil
+}
+
+func (f *fakeScm) IsTeamMember(team string, user string) (bool, error) {
+	for _, t := range f.teams {
+		if t == team {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// visible returns the comments without the status encoded in them.
+func visible(comments []string) []string {
+	var out []string
+	for _, comment := range comments {
+		if i := strings.Index(comment, "\n<!-- backport-status:"); i >= 0 {
+			comment = comment[:i]
+		}
+		out = append(out, comment)
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/sirupsen/logrus"
+)
+
+// configs caches the configuration of each repository by the commit at the head of
+// its default branch, so that it is only read again once the branch has moved on.
+type configs struct {
+	mu    sync.Mutex
+	repos map[string]cachedConfig
+}
+
+type cachedConfig struct {
+	sha    string
+	config *service.RepoConfig
+	err    error
+}
+
+// get returns the repository's configuration, read at sha when it has not been
+// cached. A configuration that is invalid is cached too, a failure to read it is not.
+func (c *configs) get(key string, sha string, read func() (*service.RepoConfig, error)) (*service.RepoConfig, error) {
+	c.mu.Lock()
+	cached, ok := c.repos[key]
+	c.mu.Unlock()
+	if ok && cached.sha == sha {
+		return cached.config, cached.err
+	}
+
+	config, err := read()
+	var configErr *ConfigError
+	if err != nil && !errors.As(err, &configErr) {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.repos == nil {
+		c.repos = map[string]cachedConfig{}
+	}
+	c.repos[key] = cachedConfig{sha: sha, config: config, err: err}
+	return config, err
+}
+
+// ConfigError is returned when a repository's configuration is invalid.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s is invalid: %v", service.ConfigPath, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// repoOptions returns the configuration of the repository, from service.ConfigPath
+// on its default branch, and the options its PRs are backported with.
+func (o *Controller) repoOptions(l *logrus.Entry, server service.Server, s service.Scm, owner string, repo string) (*service.RepoConfig, service.BackportOptions, error) {
+	sha, err := s.FindDefaultBranchSha(owner, repo)
+	if err != nil {
+		return nil, o.Options, err
+	}
+
+	config, err := o.configs.get(fmt.Sprintf("%s/%s/%s", server.URL, owner, repo), sha, func() (*service.RepoConfig, error) {
+		l.Debugf("reading %s at %s", service.ConfigPath, sha)
+		data, err := s.ReadFileFromRepo(owner, repo, service.ConfigPath, sha)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return &service.RepoConfig{}, nil
+		}
+
+		config, err := service.ParseRepoConfig(data)
+		if err != nil {
+			return nil, &ConfigError{Err: err}
+		}
+		return config, nil
+	})
+	if err != nil {
+		return nil, o.Options, err
+	}
+
+	opts, err := config.Options(o.Options)
+	if err != nil {
+		return nil, o.Options, &ConfigError{Err: err}
+	}
+	return config, opts, nil
+}
@@ -0,0 +1,59 @@
+package webhook
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deliveryTTL is how long a delivery is remembered for, github only allows a
+// webhook to be redelivered for 3 days.
+const deliveryTTL = 72 * time.Hour
+
+// deliveries records the ids of the webhooks that have been handled. They are only
+// held in memory, so a webhook redelivered after a restart is processed again.
+type deliveries struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// record records the delivery, reporting false if it has already been recorded.
+func (d *deliveries) record(id string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen == nil {
+		d.seen = map[string]time.Time{}
+	}
+
+	for delivery, at := range d.seen {
+		if now.Sub(at) > deliveryTTL {
+			delete(d.seen, delivery)
+		}
+	}
+
+	if _, ok := d.seen[id]; ok {
+		return false
+	}
+	d.seen[id] = now
+	return true
+}
+
+// forget forgets the delivery, so that it is processed again if it is redelivered.
+func (d *deliveries) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.seen, id)
+}
+
+// deliveryID returns the unique id each provider gives a webhook delivery, which
+// is kept when the webhook is redelivered, or "" if there is none.
+func deliveryID(h http.Header) string {
+	for _, name := range []string{"X-GitHub-Delivery", "X-Gitlab-Event-UUID", "X-Gitea-Delivery", "X-Request-Id"} {
+		if id := h.Get(name); id != "" {
+			return id
+		}
+	}
+	return ""
+}
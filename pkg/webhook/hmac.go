@@ -1,7 +1,10 @@
 package webhook
 
 import (
+	"crypto/subtle"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -25,3 +28,26 @@ func HMACToken() string {
 	}
 	return hmacToken
 }
+
+// Authenticated only passes on the requests that carry the HMAC token as a bearer
+// token, e.g. Authorization: Bearer $HMAC_TOKEN, so that the endpoints that reveal
+// or fetch from the repositories are not open to anyone. They are disabled when there
+// is no HMAC token.
+func Authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(HMACToken())
+		if token == "" {
+			responseHTTPError(w, http.StatusForbidden, "403 Forbidden: HMAC_TOKEN is not set")
+			return
+		}
+
+		given := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			responseHTTPError(w, http.StatusUnauthorized, "401 Unauthorized: expected the HMAC token as a bearer token")
+			return
+		}
+
+		next(w, r)
+	}
+}
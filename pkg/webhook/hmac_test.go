@@ -0,0 +1,64 @@
+package webhook_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticated(t *testing.T) {
+	type test struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}
+
+	tests := []test{
+		{
+			name:          "bearer token",
+			token:         "secret",
+			authorization: "Bearer secret",
+			status:        http.StatusOK,
+		},
+		{
+			name:          "wrong token",
+			token:         "secret",
+			authorization: "Bearer guess",
+			status:        http.StatusUnauthorized,
+		},
+		{
+			name:   "no token",
+			token:  "secret",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:          "no HMAC token configured",
+			authorization: "Bearer ",
+			status:        http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("HMAC_TOKEN", test.token)
+			t.Setenv("HMAC_TOKEN_PATH", "")
+
+			handler := webhook.Authenticated(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			assert.Equal(t, test.status, w.Code)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Jobs returns the status of all the backport jobs.
+func (o *Controller) Jobs(w http.ResponseWriter, _ *http.Request) {
+	if o.Queue == nil {
+		responseHTTPError(w, http.StatusNotFound, "404 Not Found: backports are not queued")
+		return
+	}
+
+	writeJSON(w, o.Queue.List())
+}
+
+// Job returns the status of the backport job identified by the id URL parameter.
+func (o *Controller) Job(w http.ResponseWriter, r *http.Request) {
+	if o.Queue == nil {
+		responseHTTPError(w, http.StatusNotFound, "404 Not Found: backports are not queued")
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		responseHTTPError(w, http.StatusBadRequest, "400 Bad Request: invalid job id")
+		return
+	}
+
+	job, ok := o.Queue.Get(id)
+	if !ok {
+		responseHTTPError(w, http.StatusNotFound, "404 Not Found: no such job")
+		return
+	}
+
+	writeJSON(w, job)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logrus.Debugf("failed to write the response: %v", err)
+	}
+}
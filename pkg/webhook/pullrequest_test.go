@@ -0,0 +1,474 @@
+package webhook_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelledPullRequest(t *testing.T) {
+	type test struct {
+		name             string
+		label            string
+		sender           string
+		merged           bool
+		backports        map[string]int
+		closedBackports  map[string]int
+		expectedBackport []string
+		expectedComments []string
+	}
+
+	tests := []test{
+		{
+			name:             "label added after merge",
+			label:            "Backport to 1.3.x",
+			merged:           true,
+			expectedBackport: []string{"1.3.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.3.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:   "label added by the bot for a comment",
+			label:  "Backport to 1.3.x",
+			sender: "Backport-Bot",
+			merged: true,
+		},
+		{
+			name:   "label added before merge",
+			label:  "Backport to 1.3.x",
+			merged: false,
+		},
+		{
+			name:   "unrelated label",
+			label:  "bug",
+			merged: true,
+		},
+		{
+			name:      "branch already has a backport PR",
+			label:     "Backport to 1.3.x",
+			merged:    true,
+			backports: map[string]int{"1.3.x": 12},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.3.x` | Already backported in https://github.com/org/repo/pull/12 |\n",
+			},
+		},
+		{
+			name:             "backport PR closed without being merged",
+			label:            "Backport to 1.3.x",
+			merged:           true,
+			closedBackports:  map[string]int{"1.3.x": 12},
+			expectedBackport: []string{"1.3.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.3.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeScm{
+				labels:          []string{"Backport to 1.2.x", test.label},
+				commits:         []string{"abc123"},
+				backports:       test.backports,
+				closedBackports: test.closedBackports,
+			}
+			c := &webhook.Controller{
+				ScmFactory: func(server service.Server) (service.Scm, error) {
+					return s, nil
+				},
+			}
+
+			w := &scm.PullRequestHook{
+				Action: scm.ActionLabel,
+				Repo: scm.Repository{
+					Namespace: "org",
+					Name:      "repo",
+					FullName:  "org/repo",
+				},
+				Label: scm.Label{Name: test.label},
+				PullRequest: scm.PullRequest{
+					Number: 1,
+					Merged: test.merged,
+				},
+				Sender: scm.User{Login: test.sender},
+			}
+
+			_, message, err := c.ProcessWebHook(logrus.WithField("test", t.Name()), githubServer, w)
+			assert.NoError(t, err)
+			assert.Equal(t, "processed PR hook", message)
+			assert.Equal(t, test.expectedBackport, s.applied)
+			assert.Equal(t, test.expectedComments, visible(s.comments))
+		})
+	}
+}
+
+func TestMergedPullRequest(t *testing.T) {
+	type test struct {
+		name             string
+		server           service.Server
+		action           scm.Action
+		merged           bool
+		expectedBackport []string
+	}
+
+	gitlabServer := service.Server{Driver: "gitlab", URL: "https://gitlab.example.com"}
+
+	tests := []test{
+		{
+			name:             "github merged PR",
+			server:           githubServer,
+			action:           scm.ActionClose,
+			merged:           true,
+			expectedBackport: []string{"1.1.x", "1.2.x"},
+		},
+		{
+			name:   "github closed PR",
+			server: githubServer,
+			action: scm.ActionClose,
+		},
+		{
+			name:             "gitlab merged MR",
+			server:           gitlabServer,
+			action:           scm.ActionMerge,
+			merged:           true,
+			expectedBackport: []string{"1.1.x", "1.2.x"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var used service.Server
+			s := &fakeScm{
+				labels:  []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+				commits: []string{"abc123"},
+			}
+			c := &webhook.Controller{
+				ScmFactory: func(server service.Server) (service.Scm, error) {
+					used = server
+					return s, nil
+				},
+			}
+
+			w := &scm.PullRequestHook{
+				Action: test.action,
+				Repo: scm.Repository{
+					Namespace: "group/subgroup",
+					Name:      "repo",
+					FullName:  "group/subgroup/repo",
+				},
+				PullRequest: scm.PullRequest{
+					Number: 1,
+					Merged: test.merged,
+				},
+			}
+
+			_, _, err := c.ProcessWebHook(logrus.WithField("test", t.Name()), test.server, w)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, test.expectedBackport, s.applied)
+			if test.merged {
+				assert.Equal(t, test.server, used)
+			}
+		})
+	}
+}
+
+func TestQueuedPullRequest(t *testing.T) {
+	s := &fakeScm{
+		labels:    []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+		commits:   []string{"abc123"},
+		backports: map[string]int{"1.2.x": 12},
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+	c.Queue = queue.New(c.RunJob, queue.Options{Workers: 1, MaxAttempts: 1})
+	assert.NoError(t, c.Queue.Start())
+	defer c.Queue.Stop()
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	_, message, err := c.ProcessWebHook(logrus.WithField("test", t.Name()), githubServer, w)
+	assert.NoError(t, err)
+	assert.Equal(t, "processed PR hook", message)
+
+	// the batch is summarised once both branches have been backported
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.comments) == 1 && strings.Contains(s.comments[0], "Created PR") && strings.Contains(s.comments[0], "Already backported")
+	}, 5*time.Second, time.Millisecond)
+
+	jobs := c.Queue.List()
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, "1.1.x", jobs[0].Branch)
+	assert.Equal(t, "1.2.x", jobs[1].Branch)
+	assert.Equal(t, 12, jobs[1].Result.Number)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []string{"1.1.x"}, s.applied)
+	assert.Len(t, s.comments, 1)
+	assert.Equal(t, "| Branch | Status |\n| --- | --- |\n"+
+		"| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n"+
+		"| `1.2.x` | Already backported in https://github.com/org/repo/pull/12 |\n", visible(s.comments)[0])
+}
+
+func TestPartiallyFailedBackport(t *testing.T) {
+	s := &fakeScm{
+		labels:   []string{"Backport to 1.1.x", "Backport to 1.2.x", "Backport to 1.3.x"},
+		commits:  []string{"abc123"},
+		failures: map[string]error{"1.1.x": errors.New("unable to cherry-pick abc123: exit status 1")},
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	// the webhook fails, so that redelivering it retries the branch that failed
+	_, _, err := c.ProcessWebHook(logrus.WithField("test", t.Name()), githubServer, w)
+	assert.EqualError(t, err, "unable to backport PR-1 to 1.1.x")
+
+	// a failure on one branch does not stop the others being backported
+	assert.ElementsMatch(t, []string{"1.1.x", "1.2.x", "1.3.x"}, s.applied)
+	assert.Equal(t, []string{"| Branch | Status |\n| --- | --- |\n" +
+		"| `1.1.x` | Failed: unable to cherry-pick abc123: exit status 1 |\n" +
+		"| `1.2.x` | Created PR https://github.com/org/repo/pull/20 |\n" +
+		"| `1.3.x` | Created PR https://github.com/org/repo/pull/20 |\n" +
+		"\n<details><summary>Backport to 1.1.x</summary>\n\n```\ngit cherry-pick -x abc123\n```\n\n</details>\n"}, visible(s.comments))
+}
+
+func TestStatusCommentLength(t *testing.T) {
+	s := &fakeScm{
+		commits:    []string{"abc123"},
+		failures:   map[string]error{},
+		failureLog: "```\n" + strings.Repeat("error: could not apply abc123\n", 300) + "```",
+	}
+	for i := 0; i < 20; i++ {
+		branch := fmt.Sprintf("1.%d.x", i)
+		s.labels = append(s.labels, "Backport to "+branch)
+		s.failures[branch] = errors.New("unable to cherry-pick abc123: exit status 1")
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	_, _, err := c.ProcessWebHook(logrus.WithField("test", t.Name()), githubServer, w)
+	assert.Error(t, err)
+
+	// the git output that does not fit is left out, but every branch is reported
+	assert.Len(t, s.comments, 1)
+	assert.LessOrEqual(t, len(s.comments[0]), 65536)
+	assert.Equal(t, 20, strings.Count(s.comments[0], "| Failed: unable to cherry-pick abc123: exit status 1 |"))
+	details := strings.Count(s.comments[0], "<details>")
+	assert.Greater(t, details, 0)
+	assert.Less(t, details, 20)
+
+	// the git output already in the comment is kept as the other branches finish
+	assert.Contains(t, s.comments[0], "<summary>Backport to 1.0.x</summary>")
+}
+
+func TestStatusComment(t *testing.T) {
+	release := make(chan struct{})
+	s := &fakeScm{
+		labels:  []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+		commits: []string{"abc123"},
+		block:   release,
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+	c.Queue = queue.New(c.RunJob, queue.Options{Workers: 1, MaxAttempts: 1})
+	assert.NoError(t, c.Queue.Start())
+	defer c.Queue.Stop()
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	_, _, err := c.ProcessWebHook(logrus.WithField("test", t.Name()), githubServer, w)
+	assert.NoError(t, err)
+
+	// one branch is being backported while the other waits for the worker
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.comments) == 1 && strings.Contains(s.comments[0], "In progress")
+	}, 5*time.Second, time.Millisecond)
+	s.mu.Lock()
+	// either branch may be picked up first
+	assert.Contains(t, []string{
+		"| Branch | Status |\n| --- | --- |\n| `1.1.x` | In progress |\n| `1.2.x` | Queued |\n",
+		"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Queued |\n| `1.2.x` | In progress |\n",
+	}, visible(s.comments)[0])
+	s.mu.Unlock()
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return !strings.Contains(s.comments[0], "Queued") && !strings.Contains(s.comments[0], "In progress")
+	}, 5*time.Second, time.Millisecond)
+
+	// the one comment was edited as the backports progressed
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []string{"| Branch | Status |\n| --- | --- |\n" +
+		"| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n" +
+		"| `1.2.x` | Created PR https://github.com/org/repo/pull/20 |\n"}, visible(s.comments))
+	assert.GreaterOrEqual(t, s.edits, 4)
+}
+
+func TestStatusCommentThatCannotBeEdited(t *testing.T) {
+	s := &fakeScm{
+		labels:      []string{"Backport to 1.1.x"},
+		commits:     []string{"abc123"},
+		editFailure: errors.New("403 Forbidden"),
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	_, _, err := c.ProcessWebHook(logrus.WithField("test", t.Name()), githubServer, w)
+	assert.NoError(t, err)
+
+	// each update of the status is posted in a new comment rather than lost
+	assert.Equal(t, []string{
+		"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Queued |\n",
+		"| Branch | Status |\n| --- | --- |\n| `1.1.x` | In progress |\n",
+		"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+	}, visible(s.comments))
+}
+
+func TestLabelRacingComment(t *testing.T) {
+	release := make(chan struct{})
+	s := &fakeScm{
+		branches: []string{"main", "1.1.x"},
+		merged:   true,
+		commits:  []string{"abc123"},
+		block:    release,
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+
+	l := logrus.WithField("test", t.Name())
+	done := make(chan error)
+	go func() {
+		done <- c.HandleComment(l, githubServer, "org", "repo", "octocat", "/backport 1.1.x", 1)
+	}()
+
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.comments) == 1 && strings.Contains(s.comments[0], "In progress")
+	}, 5*time.Second, time.Millisecond)
+
+	// the label added by the comment arrives while the branch is being backported
+	w := &scm.PullRequestHook{
+		Action: scm.ActionLabel,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		Label: scm.Label{Name: "Backport to 1.1.x"},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+	_, _, err := c.ProcessWebHook(l, githubServer, w)
+	assert.NoError(t, err)
+	s.mu.Lock()
+	assert.NotContains(t, s.comments[0], "Failed")
+	s.mu.Unlock()
+
+	close(release)
+	assert.NoError(t, <-done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []string{"1.1.x"}, s.applied)
+	assert.Equal(t, []string{"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n"}, visible(s.comments))
+}
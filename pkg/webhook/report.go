@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reportStatus handles the /backport status command in the comment, replying with a
+// table of the requested branches, their backport PRs and jobs. A branch without a
+// job, such as when there is no queue, is described by the status comment instead.
+func (o *Controller) reportStatus(l *logrus.Entry, server service.Server, s service.Scm, owner string, repo string, pr int, body string, config *service.RepoConfig, opts service.BackportOptions) error {
+	commands, _ := parseCommands(body)
+	if len(commandsWithAction(commands, actionStatus)) == 0 {
+		return nil
+	}
+
+	requested, err := s.DetermineBranchesForPr(owner, repo, pr, config.Prefix())
+	if err != nil {
+		return err
+	}
+
+	if len(requested) == 0 {
+		return s.AddCommentToPr(owner, repo, pr, fmt.Sprintf("No backports have been requested for PR-%d", pr))
+	}
+
+	merged, err := s.IsPrMerged(owner, repo, pr)
+	if err != nil {
+		return err
+	}
+
+	jobs := o.latestJobs(server, owner, repo, pr)
+	var statuses map[string]branchStatus
+
+	var b strings.Builder
+	if !merged {
+		fmt.Fprintf(&b, "PR-%d has not been merged, it will be backported once it is.\n\n", pr)
+	}
+	b.WriteString("| Branch | Backport PR | Job |\n")
+	b.WriteString("| --- | --- | --- |\n")
+	for _, branch := range requested {
+		backport, err := s.FindBackportPr(owner, repo, pr, branch, opts)
+		if err != nil {
+			return err
+		}
+
+		link := "None"
+		if backport != nil {
+			state := "open"
+			if backport.Merged {
+				state = "merged"
+			} else if backport.Closed {
+				state = "closed"
+			}
+			link = fmt.Sprintf("%s (%s)", backport.Link, state)
+		}
+
+		job := "None"
+		if j, ok := jobs[branch]; ok {
+			job = describeJob(j)
+		} else {
+			if statuses == nil {
+				statuses, err = commentStatuses(s, owner, repo, pr)
+				if err != nil {
+					return err
+				}
+			}
+			if st, ok := statuses[branch]; ok {
+				job = st.describe()
+			}
+		}
+
+		fmt.Fprintf(&b, "| `%s` | %s | %s |\n", branch, cell(link), cell(job))
+	}
+
+	l.Infof("reporting the status of the backports of PR-%d", pr)
+	return s.AddCommentToPr(owner, repo, pr, b.String())
+}
+
+// latestJobs returns the most recent job for each branch the PR has been backported
+// to, there are none without a queue.
+func (o *Controller) latestJobs(server service.Server, owner string, repo string, pr int) map[string]queue.Job {
+	jobs := map[string]queue.Job{}
+	if o.Queue == nil {
+		return jobs
+	}
+
+	// the jobs are listed oldest first
+	for _, job := range o.Queue.List() {
+		if job.Server.URL == server.URL && job.Owner == owner && job.Repo == repo && job.PR == pr {
+			jobs[job.Branch] = job
+		}
+	}
+	return jobs
+}
+
+// commentStatuses returns the status of each branch recorded in the status comment
+// on the PR.
+func commentStatuses(s service.Scm, owner string, repo string, pr int) (map[string]branchStatus, error) {
+	_, body, err := s.FindCommentOnPr(owner, repo, pr, statusMarker)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := map[string]branchStatus{}
+	for _, st := range parseStatus(body).Branches {
+		statuses[st.Branch] = st
+	}
+	return statuses, nil
+}
+
+// describeJob explains where the job has got to.
+func describeJob(job queue.Job) string {
+	switch job.Status {
+	case queue.StatusPending:
+		if job.Attempts > 0 {
+			return fmt.Sprintf("Pending, attempt %d failed: %s", job.Attempts, job.LastError)
+		}
+		return "Pending"
+	case queue.StatusRunning:
+		return "In progress"
+	case queue.StatusFailed:
+		return fmt.Sprintf("Failed: %s", job.LastError)
+	case queue.StatusCancelled:
+		return "Cancelled"
+	default:
+		return "Succeeded"
+	}
+}
@@ -0,0 +1,179 @@
+package webhook_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportStatus(t *testing.T) {
+	type test struct {
+		name             string
+		body             string
+		labels           []string
+		merged           bool
+		backports        map[string]int
+		expectedComments []string
+	}
+
+	tests := []test{
+		{
+			name:   "backport PRs",
+			body:   "/backport status",
+			labels: []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+			merged: true,
+			backports: map[string]int{
+				"1.2.x": 12,
+			},
+			expectedComments: []string{
+				"| Branch | Backport PR | Job |\n| --- | --- | --- |\n" +
+					"| `1.1.x` | None | None |\n" +
+					"| `1.2.x` | https://github.com/org/repo/pull/12 (open) | None |\n",
+			},
+		},
+		{
+			name:   "PR that has not been merged",
+			body:   "/backport status",
+			labels: []string{"Backport to 1.1.x"},
+			expectedComments: []string{
+				"PR-1 has not been merged, it will be backported once it is.\n\n" +
+					"| Branch | Backport PR | Job |\n| --- | --- | --- |\n" +
+					"| `1.1.x` | None | None |\n",
+			},
+		},
+		{
+			name:             "no backports requested",
+			body:             "/backport status",
+			merged:           true,
+			expectedComments: []string{"No backports have been requested for PR-1"},
+		},
+		{
+			name:             "branches given",
+			body:             "/backport status 1.1.x",
+			labels:           []string{"Backport to 1.1.x"},
+			expectedComments: []string{"Unable to parse `/backport status 1.1.x`, `/backport status` does not take any branches"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeScm{
+				branches:  []string{"main", "1.1.x", "1.2.x"},
+				labels:    test.labels,
+				merged:    test.merged,
+				backports: test.backports,
+			}
+			c := &webhook.Controller{
+				ScmFactory: func(server service.Server) (service.Scm, error) {
+					return s, nil
+				},
+			}
+
+			err := c.HandleComment(logrus.WithField("test", t.Name()), githubServer, "org", "repo", "octocat", test.body, 1)
+			assert.NoError(t, err)
+			assert.Empty(t, s.addedLabels)
+			assert.Empty(t, s.applied)
+			assert.Equal(t, test.expectedComments, s.comments)
+		})
+	}
+}
+
+func TestReportQueuedStatus(t *testing.T) {
+	s := &fakeScm{
+		labels:    []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+		merged:    true,
+		commits:   []string{"abc123"},
+		backports: map[string]int{"1.2.x": 12},
+		failures:  map[string]error{"1.1.x": errors.New("unable to push backport-PR-1-to-1.1.x")},
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+	c.Queue = queue.New(c.RunJob, queue.Options{Workers: 1, MaxAttempts: 1})
+	require.NoError(t, c.Queue.Start())
+	defer c.Queue.Stop()
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	l := logrus.WithField("test", t.Name())
+	_, _, err := c.ProcessWebHook(l, githubServer, w)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.comments) == 1 && strings.Contains(s.comments[0], "Failed") && strings.Contains(s.comments[0], "Already backported")
+	}, 5*time.Second, time.Millisecond)
+
+	err = c.HandleComment(l, githubServer, "org", "repo", "octocat", "/backport status", 1)
+	assert.NoError(t, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Len(t, s.comments, 2)
+	assert.Equal(t, "| Branch | Backport PR | Job |\n| --- | --- | --- |\n"+
+		"| `1.1.x` | None | Failed: unable to push backport-PR-1-to-1.1.x |\n"+
+		"| `1.2.x` | https://github.com/org/repo/pull/12 (open) | Succeeded |\n", s.comments[1])
+}
+
+func TestReportStatusWithoutQueue(t *testing.T) {
+	s := &fakeScm{
+		labels:   []string{"Backport to 1.1.x"},
+		commits:  []string{"abc123"},
+		merged:   true,
+		failures: map[string]error{"1.1.x": errors.New("unable to push backport-PR-1-to-1.1.x")},
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	l := logrus.WithField("test", t.Name())
+	_, _, err := c.ProcessWebHook(l, githubServer, w)
+	assert.Error(t, err)
+
+	err = c.HandleComment(l, githubServer, "org", "repo", "octocat", "/backport status", 1)
+	assert.NoError(t, err)
+
+	// the state of the backport is read from the status comment
+	require.Len(t, s.comments, 2)
+	assert.Equal(t, "| Branch | Backport PR | Job |\n| --- | --- | --- |\n"+
+		"| `1.1.x` | None | Failed: unable to push backport-PR-1-to-1.1.x |\n", s.comments[1])
+}
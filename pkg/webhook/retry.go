@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/sirupsen/logrus"
+)
+
+// retryBackports handles the /backport retry commands in the comment, backporting
+// the merged PR again to each requested branch, or those the commands name, that does
+// not have a backport PR yet. It reports whether any backports were queued.
+func (o *Controller) retryBackports(l *logrus.Entry, server service.Server, s service.Scm, owner string, repo string, pr int, body string, config *service.RepoConfig, opts service.BackportOptions) (bool, error) {
+	commands, _ := parseCommands(body)
+	commands = commandsWithAction(commands, actionRetry)
+	if len(commands) == 0 {
+		return false, nil
+	}
+
+	requested, err := s.DetermineBranchesForPr(owner, repo, pr, config.Prefix())
+	if err != nil {
+		return false, err
+	}
+
+	// a retry without any branches retries every requested branch
+	all := false
+	var args []string
+	for _, c := range commands {
+		all = all || len(c.args) == 0
+		args = append(args, c.args...)
+	}
+
+	branches, messages := requested, []string(nil)
+	if !all {
+		branches, messages = matchRequested(args, requested, actionRetry)
+	}
+	if len(branches) == 0 && len(messages) == 0 {
+		messages = append(messages, "Unable to retry the backports, none have been requested")
+	}
+
+	var targets []string
+	for _, branch := range branches {
+		if !config.AllowsBranch(branch) {
+			messages = append(messages, fmt.Sprintf("Backporting to %s is not allowed by %s", branch, service.ConfigPath))
+			continue
+		}
+		targets = append(targets, branch)
+	}
+
+	if len(targets) > 0 {
+		merged, err := s.IsPrMerged(owner, repo, pr)
+		if err != nil {
+			return false, err
+		}
+		if !merged {
+			messages = append(messages, fmt.Sprintf("Unable to retry the backports, PR-%d has not been merged", pr))
+			targets = nil
+		}
+	}
+
+	for _, message := range messages {
+		err := s.AddCommentToPr(owner, repo, pr, message)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// the branches that have an open or merged backport PR are done, only the failed
+	// and missing ones, and those whose backport PR was closed, are backported again
+	var retry []string
+	var existing []branchStatus
+	for _, branch := range targets {
+		backport, err := s.FindBackportPr(owner, repo, pr, branch, opts)
+		if err != nil {
+			return false, err
+		}
+		if backported(backport) {
+			l.Infof("PR-%d has already been backported to %s in PR-%d, not retrying", pr, branch, backport.Number)
+			result := service.BackportResult{Branch: branch, Number: backport.Number, Link: backport.Link, Existing: true}
+			existing = append(existing, finished(branch, result, nil))
+			continue
+		}
+
+		if o.Queue != nil {
+			o.Queue.Forget(server, owner, repo, pr, branch)
+		}
+		retry = append(retry, branch)
+	}
+
+	if len(existing) > 0 {
+		o.setStatus(l, s, owner, repo, pr, existing...)
+	}
+
+	return o.backportBranches(l, server, s, owner, repo, pr, retry, config, opts)
+}
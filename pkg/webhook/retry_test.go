@@ -0,0 +1,166 @@
+package webhook_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/backport/pkg/queue"
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBackports(t *testing.T) {
+	type test struct {
+		name             string
+		body             string
+		labels           []string
+		merged           bool
+		backports        map[string]int
+		closedBackports  map[string]int
+		expectedBackport []string
+		expectedComments []string
+	}
+
+	tests := []test{
+		{
+			name:             "retry the branches without a backport PR",
+			body:             "/backport retry",
+			labels:           []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+			merged:           true,
+			backports:        map[string]int{"1.2.x": 12},
+			expectedBackport: []string{"1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n" +
+					"| `1.2.x` | Already backported in https://github.com/org/repo/pull/12 |\n" +
+					"| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:             "retry a branch whose backport PR was closed without being merged",
+			body:             "/backport retry",
+			labels:           []string{"Backport to 1.1.x"},
+			merged:           true,
+			closedBackports:  map[string]int{"1.1.x": 12},
+			expectedBackport: []string{"1.1.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.1.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:             "retry a single branch",
+			body:             "/backport retry 1.2.x",
+			labels:           []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+			merged:           true,
+			expectedBackport: []string{"1.2.x"},
+			expectedComments: []string{
+				"| Branch | Status |\n| --- | --- |\n| `1.2.x` | Created PR https://github.com/org/repo/pull/20 |\n",
+			},
+		},
+		{
+			name:             "branch that was not requested",
+			body:             "/backport retry 1.3.x",
+			labels:           []string{"Backport to 1.1.x"},
+			merged:           true,
+			expectedComments: []string{"Unable to retry the backport to 1.3.x, it has not been requested"},
+		},
+		{
+			name:             "no branches requested",
+			body:             "/backport retry",
+			merged:           true,
+			expectedComments: []string{"Unable to retry the backports, none have been requested"},
+		},
+		{
+			name:             "PR that has not been merged",
+			body:             "/backport retry",
+			labels:           []string{"Backport to 1.1.x"},
+			expectedComments: []string{"Unable to retry the backports, PR-1 has not been merged"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeScm{
+				branches:        []string{"main", "1.1.x", "1.2.x", "1.3.x"},
+				labels:          test.labels,
+				merged:          test.merged,
+				commits:         []string{"abc123"},
+				backports:       test.backports,
+				closedBackports: test.closedBackports,
+			}
+			c := &webhook.Controller{
+				ScmFactory: func(server service.Server) (service.Scm, error) {
+					return s, nil
+				},
+			}
+
+			err := c.HandleComment(logrus.WithField("test", t.Name()), githubServer, "org", "repo", "octocat", test.body, 1)
+			assert.NoError(t, err)
+			assert.Empty(t, s.addedLabels)
+			assert.Equal(t, test.expectedBackport, s.applied)
+			assert.Equal(t, test.expectedComments, visible(s.comments))
+		})
+	}
+}
+
+func TestRetryFailedBackport(t *testing.T) {
+	s := &fakeScm{
+		labels:   []string{"Backport to 1.1.x"},
+		merged:   true,
+		commits:  []string{"abc123"},
+		failures: map[string]error{"1.1.x": errors.New("unable to push backport-PR-1-to-1.1.x")},
+	}
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			return s, nil
+		},
+	}
+	c.Queue = queue.New(c.RunJob, queue.Options{Workers: 1, MaxAttempts: 1})
+	require.NoError(t, c.Queue.Start())
+	defer c.Queue.Stop()
+
+	w := &scm.PullRequestHook{
+		Action: scm.ActionClose,
+		Repo: scm.Repository{
+			Namespace: "org",
+			Name:      "repo",
+			FullName:  "org/repo",
+		},
+		PullRequest: scm.PullRequest{
+			Number: 1,
+			Merged: true,
+		},
+	}
+
+	l := logrus.WithField("test", t.Name())
+	_, _, err := c.ProcessWebHook(l, githubServer, w)
+	require.NoError(t, err)
+
+	waitForComment := func(status string) {
+		assert.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.comments) == 1 && strings.Contains(s.comments[0], status)
+		}, 5*time.Second, time.Millisecond)
+	}
+	waitForComment("Failed: unable to push")
+
+	s.mu.Lock()
+	s.failures = nil
+	s.mu.Unlock()
+
+	err = c.HandleComment(l, githubServer, "org", "repo", "octocat", "/backport retry 1.1.x", 1)
+	assert.NoError(t, err)
+	waitForComment("Created PR")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []string{"1.1.x", "1.1.x"}, s.applied)
+	assert.Len(t, c.Queue.List(), 2)
+}
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/garethjevans/backport/pkg/service"
+)
+
+// ServerForRequest determines the git server that sent the webhook from the event
+// header set by each provider, falling back to $GIT_KIND and then github.
+// The URL is taken from the repository in the payload, e.g. for github enterprise,
+// $GIT_SERVER overrides the URL of the configured kind.
+func ServerForRequest(r *http.Request, payload []byte) service.Server {
+	kind := os.Getenv("GIT_KIND")
+
+	driver := driverFromHeaders(r.Header)
+	if driver == "" {
+		driver = kind
+	}
+	if driver == "" {
+		driver = service.DriverGitHub
+	}
+
+	u := os.Getenv("GIT_SERVER")
+	if u == "" || (kind != "" && kind != driver) {
+		u = serverURLFromPayload(payload)
+	}
+	if u == "" {
+		u = service.DefaultURL(driver)
+	}
+
+	return service.Server{Driver: driver, URL: u}
+}
+
+// webhookPayload holds the fields of each provider's payload that describe the
+// repository, just enough to work out the URL of the server.
+type webhookPayload struct {
+	// github and gitea
+	Repository struct {
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	// gitlab
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	// bitbucket server
+	PullRequest struct {
+		ToRef struct {
+			Repository struct {
+				Links struct {
+					Self []struct {
+						Href string `json:"href"`
+					} `json:"self"`
+				} `json:"links"`
+			} `json:"repository"`
+		} `json:"toRef"`
+	} `json:"pullRequest"`
+}
+
+// serverURLFromPayload returns the URL of the server the repository in the payload is
+// hosted on, keeping any context path, or "" if it cannot be determined.
+func serverURLFromPayload(payload []byte) string {
+	var p webhookPayload
+	if len(payload) == 0 || json.Unmarshal(payload, &p) != nil {
+		return ""
+	}
+
+	switch {
+	case p.Repository.HTMLURL != "" && p.Repository.FullName != "":
+		return trimRepositoryPath(p.Repository.HTMLURL, "/"+p.Repository.FullName)
+	case p.Project.WebURL != "" && p.Project.PathWithNamespace != "":
+		return trimRepositoryPath(p.Project.WebURL, "/"+p.Project.PathWithNamespace)
+	case len(p.PullRequest.ToRef.Repository.Links.Self) > 0:
+		// e.g. https://bitbucket.example.com/projects/PRJ/repos/repo/browse
+		href := p.PullRequest.ToRef.Repository.Links.Self[0].Href
+		if i := strings.Index(href, "/projects/"); i > 0 {
+			return href[:i]
+		}
+	}
+	return ""
+}
+
+func trimRepositoryPath(link string, path string) string {
+	if !strings.HasSuffix(link, path) {
+		return ""
+	}
+	return strings.TrimSuffix(link, path)
+}
+
+func driverFromHeaders(h http.Header) string {
+	switch {
+	case h.Get("X-GitHub-Event") != "":
+		return service.DriverGitHub
+	case h.Get("X-Gitlab-Event") != "":
+		return service.DriverGitLab
+	case h.Get("X-Gitea-Event") != "", h.Get("X-Forgejo-Event") != "":
+		return service.DriverGitea
+	case isBitbucketServerEvent(h.Get("X-Event-Key")):
+		return service.DriverBitbucketServer
+	default:
+		return ""
+	}
+}
+
+// isBitbucketServerEvent distinguishes bitbucket server events, e.g. pr:comment:added,
+// from the bitbucket cloud events that share the X-Event-Key header.
+func isBitbucketServerEvent(key string) bool {
+	return strings.HasPrefix(key, "pr:") || key == "repo:refs_changed" || key == "diagnostics:ping"
+}
+
+// normalizeHeaders copies the X-Forgejo-* headers sent by forgejo to the
+// X-Gitea-* equivalents that the gitea driver expects.
+func normalizeHeaders(h http.Header) {
+	for _, name := range []string{"Event", "Delivery", "Signature"} {
+		if h.Get("X-Gitea-"+name) == "" && h.Get("X-Forgejo-"+name) != "" {
+			h.Set("X-Gitea-"+name, h.Get("X-Forgejo-"+name))
+		}
+	}
+}
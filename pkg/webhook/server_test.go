@@ -0,0 +1,124 @@
+package webhook_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/garethjevans/backport/pkg/service"
+	"github.com/garethjevans/backport/pkg/webhook"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var githubServer = service.Server{Driver: "github", URL: "https://github.com"}
+
+func TestServerForRequest(t *testing.T) {
+	type test struct {
+		name     string
+		headers  map[string]string
+		payload  string
+		kind     string
+		server   string
+		expected service.Server
+	}
+
+	tests := []test{
+		{
+			name:     "github webhook",
+			headers:  map[string]string{"X-GitHub-Event": "issue_comment"},
+			expected: githubServer,
+		},
+		{
+			name:     "gitlab webhook",
+			headers:  map[string]string{"X-Gitlab-Event": "Note Hook"},
+			expected: service.Server{Driver: "gitlab", URL: "https://gitlab.com"},
+		},
+		{
+			name:     "self hosted gitlab",
+			headers:  map[string]string{"X-Gitlab-Event": "Merge Request Hook"},
+			kind:     "gitlab",
+			server:   "https://gitlab.example.com",
+			expected: service.Server{Driver: "gitlab", URL: "https://gitlab.example.com"},
+		},
+		{
+			name:     "github webhook with gitlab configured",
+			headers:  map[string]string{"X-GitHub-Event": "issue_comment"},
+			kind:     "gitlab",
+			server:   "https://gitlab.example.com",
+			expected: githubServer,
+		},
+		{
+			name:     "gitea webhook",
+			headers:  map[string]string{"X-Gitea-Event": "issue_comment"},
+			kind:     "gitea",
+			server:   "https://gitea.example.com",
+			expected: service.Server{Driver: "gitea", URL: "https://gitea.example.com"},
+		},
+		{
+			name:     "forgejo webhook",
+			headers:  map[string]string{"X-Forgejo-Event": "pull_request"},
+			kind:     "gitea",
+			server:   "https://forgejo.example.com",
+			expected: service.Server{Driver: "gitea", URL: "https://forgejo.example.com"},
+		},
+		{
+			name:     "bitbucket server webhook",
+			headers:  map[string]string{"X-Event-Key": "pr:comment:added"},
+			kind:     "stash",
+			server:   "https://bitbucket.example.com",
+			expected: service.Server{Driver: "stash", URL: "https://bitbucket.example.com"},
+		},
+		{
+			name:     "bitbucket cloud webhook is not bitbucket server",
+			headers:  map[string]string{"X-Event-Key": "pullrequest:comment_created"},
+			expected: githubServer,
+		},
+		{
+			name:     "github enterprise webhook",
+			headers:  map[string]string{"X-GitHub-Event": "issue_comment"},
+			payload:  `{"repository": {"full_name": "org/repo", "html_url": "https://github.example.com/org/repo"}}`,
+			expected: service.Server{Driver: "github", URL: "https://github.example.com"},
+		},
+		{
+			name:     "gitlab webhook with a subgroup and relative url",
+			headers:  map[string]string{"X-Gitlab-Event": "Note Hook"},
+			payload:  `{"project": {"path_with_namespace": "group/sub/repo", "web_url": "https://example.com/gitlab/group/sub/repo"}}`,
+			expected: service.Server{Driver: "gitlab", URL: "https://example.com/gitlab"},
+		},
+		{
+			name:     "bitbucket server webhook with a context path",
+			headers:  map[string]string{"X-Event-Key": "pr:merged"},
+			payload:  `{"pullRequest": {"toRef": {"repository": {"links": {"self": [{"href": "https://example.com/bitbucket/projects/PRJ/repos/repo/browse"}]}}}}}`,
+			expected: service.Server{Driver: "stash", URL: "https://example.com/bitbucket"},
+		},
+		{
+			name:     "configured server overrides the payload",
+			headers:  map[string]string{"X-GitHub-Event": "issue_comment"},
+			payload:  `{"repository": {"full_name": "org/repo", "html_url": "https://github.example.com/org/repo"}}`,
+			kind:     "github",
+			server:   "https://github.internal",
+			expected: service.Server{Driver: "github", URL: "https://github.internal"},
+		},
+		{
+			name:     "unknown webhook uses configured kind",
+			kind:     "gitlab",
+			server:   "https://gitlab.example.com",
+			expected: service.Server{Driver: "gitlab", URL: "https://gitlab.example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GIT_KIND", test.kind)
+			t.Setenv("GIT_SERVER", test.server)
+
+			r, err := http.NewRequest("POST", "/", http.NoBody)
+			assert.NoError(t, err)
+			for k, v := range test.headers {
+				r.Header.Add(k, v)
+			}
+
+			assert.Equal(t, test.expected, webhook.ServerForRequest(r, []byte(test.payload)))
+		})
+	}
+}
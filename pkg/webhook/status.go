@@ -0,0 +1,291 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/garethjevans/backport/pkg/service"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusMarker identifies the comment that holds the status of a PR's backports, it
+// is followed by the encoded status so that the comment can be updated in place.
+const statusMarker = "<!-- backport-status:"
+
+// maxLogLength limits the git output kept for each branch, so that the comment stays
+// within the size the providers allow.
+const maxLogLength = 8000
+
+// maxCommentLength is the longest comment github allows, the git output of the
+// failed backports is left out of the status comment rather than exceed it.
+const maxCommentLength = 65536
+
+// the states a backport to a branch moves through.
+const (
+	stateQueued  = "queued"
+	stateRunning = "in progress"
+	stateDone    = "done"
+	stateFailed  = "failed"
+	// stateCancelled is a backport that was cancelled before it ran, or after its
+	// backport PR was opened.
+	stateCancelled = "cancelled"
+)
+
+// branchStatus is where the backport to a branch has got to.
+type branchStatus struct {
+	Branch string                 `json:"branch"`
+	State  string                 `json:"state"`
+	Result service.BackportResult `json:"result"`
+	Err    string                 `json:"error,omitempty"`
+	// Log is the git output of a backport that failed, it is shown in the comment and
+	// read back from there rather than encoded in the status a second time.
+	Log string `json:"-"`
+	// Closed is set when the backport PR was closed as the backport was cancelled.
+	Closed bool `json:"closed,omitempty"`
+}
+
+// status is the status of the backports of a PR, in the order they were requested.
+type status struct {
+	Branches []branchStatus `json:"branches"`
+}
+
+// queued returns the status of backports that are waiting to run.
+func queued(branches []string) []branchStatus {
+	var statuses []branchStatus
+	for _, branch := range branches {
+		statuses = append(statuses, branchStatus{Branch: branch, State: stateQueued})
+	}
+	return statuses
+}
+
+// finished returns the status of a backport that has finished with result and err.
+func finished(branch string, result service.BackportResult, err error) branchStatus {
+	if err != nil {
+		return branchStatus{Branch: branch, State: stateFailed, Result: result, Err: err.Error(), Log: truncate(result.Log)}
+	}
+	return branchStatus{Branch: branch, State: stateDone, Result: result}
+}
+
+// truncate keeps the end of the log, where the failure is.
+func truncate(log string) string {
+	if len(log) <= maxLogLength {
+		return log
+	}
+	return "```\n...\n" + log[len(log)-maxLogLength:]
+}
+
+// parseStatus reads the status encoded in the body of the status comment, starting
+// afresh if it cannot be read.
+func parseStatus(body string) status {
+	st := status{}
+
+	i := strings.Index(body, statusMarker)
+	if i < 0 {
+		return st
+	}
+	encoded := body[i+len(statusMarker):]
+	if j := strings.Index(encoded, "-->"); j >= 0 {
+		encoded = encoded[:j]
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err == nil {
+		err = json.Unmarshal(data, &st)
+	}
+	if err != nil {
+		logrus.Warnf("unable to read the backport status, starting again: %v", err)
+		return status{}
+	}
+
+	for j := range st.Branches {
+		if st.Branches[j].State == stateFailed {
+			st.Branches[j].Log = parseLog(body[:i], st.Branches[j].Branch)
+		}
+	}
+	return st
+}
+
+// parseLog reads the git output of the backport to branch from its details in the
+// body of the status comment, or returns "" if it was left out.
+func parseLog(body string, branch string) string {
+	start := fmt.Sprintf(logStart, branch)
+	i := strings.Index(body, start)
+	if i < 0 {
+		return ""
+	}
+	log := body[i+len(start):]
+	j := strings.Index(log, logEnd)
+	if j < 0 {
+		return ""
+	}
+	return log[:j]
+}
+
+// update replaces the status of the branch, adding it if it is new.
+func (st *status) update(b branchStatus) {
+	for i := range st.Branches {
+		if st.Branches[i].Branch == b.Branch {
+			st.Branches[i] = b
+			return
+		}
+	}
+	st.Branches = append(st.Branches, b)
+}
+
+// logStart and logEnd surround the git output of the backport to a branch in the
+// status comment.
+const (
+	logStart = "\n<details><summary>Backport to %s</summary>\n\n"
+	logEnd   = "\n\n</details>\n"
+)
+
+// render renders the status as a table, followed by the git output of each backport
+// that failed and the encoded status. The git output that would make the comment
+// longer than maxCommentLength is left out.
+func (st *status) render() (string, error) {
+	var table strings.Builder
+	table.WriteString("| Branch | Status |\n")
+	table.WriteString("| --- | --- |\n")
+	for _, branch := range st.Branches {
+		fmt.Fprintf(&table, "| `%s` | %s |\n", branch.Branch, cell(branch.describe()))
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	encoded := fmt.Sprintf("\n%s%s -->\n", statusMarker, base64.StdEncoding.EncodeToString(data))
+
+	var logs strings.Builder
+	remaining := maxCommentLength - table.Len() - len(encoded)
+	for _, branch := range st.Branches {
+		if branch.State != stateFailed || branch.Log == "" {
+			continue
+		}
+		details := fmt.Sprintf(logStart, branch.Branch) + branch.Log + logEnd
+		if len(details) > remaining {
+			logrus.Warnf("leaving the git output of the backport to %s out of the status comment", branch.Branch)
+			continue
+		}
+		logs.WriteString(details)
+		remaining -= len(details)
+	}
+
+	return table.String() + logs.String() + encoded, nil
+}
+
+// describe explains the status in a sentence.
+func (b *branchStatus) describe() string {
+	switch {
+	case b.State == stateQueued:
+		return "Queued"
+	case b.State == stateRunning:
+		return "In progress"
+	case b.State == stateFailed:
+		return fmt.Sprintf("Failed: %s", b.Err)
+	case b.State == stateCancelled && b.Closed:
+		return fmt.Sprintf("Cancelled, closed PR %s", b.Result.Link)
+	case b.State == stateCancelled && b.Result.Link != "":
+		return fmt.Sprintf("Cancelled, PR %s was not closed", b.Result.Link)
+	case b.State == stateCancelled:
+		return "Cancelled"
+	case b.Result.Existing:
+		return fmt.Sprintf("Already backported in %s", b.Result.Link)
+	case b.Result.Conflict != "":
+		return fmt.Sprintf("Draft PR %s, the cherry-pick of %s conflicted and needs resolving by hand", b.Result.Link, b.Result.Conflict)
+	case b.Result.Updated:
+		return fmt.Sprintf("Updated PR %s", b.Result.Link)
+	default:
+		return fmt.Sprintf("Created PR %s", b.Result.Link)
+	}
+}
+
+// cell escapes s to fit in a single markdown table cell.
+func cell(s string) string {
+	s = strings.ReplaceAll(s, "|", "\\|")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// setStatus updates the status comment on the PR with the statuses, creating the
+// comment if the PR does not have one yet. A failure to update the comment is
+// logged rather than failing the backport.
+func (o *Controller) setStatus(l *logrus.Entry, s service.Scm, owner string, repo string, pr int, statuses ...branchStatus) {
+	// the status is read, updated and written back, so the updates to a PR's status
+	// are made one at a time
+	unlock := o.statusLocks.lock(fmt.Sprintf("%s/%s/%d", owner, repo, pr))
+	defer unlock()
+
+	id, body, err := s.FindCommentOnPr(owner, repo, pr, statusMarker)
+	if err != nil {
+		l.Errorf("unable to find the status comment on PR-%d: %v", pr, err)
+		return
+	}
+
+	st := parseStatus(body)
+	for _, b := range statuses {
+		st.update(b)
+	}
+
+	comment, err := st.render()
+	if err != nil {
+		l.Errorf("unable to render the status of PR-%d: %v", pr, err)
+		return
+	}
+
+	if id != 0 {
+		err = s.EditCommentOnPr(owner, repo, pr, id, comment)
+		if err == nil {
+			return
+		}
+		// the comment may have been deleted or locked, the status is posted afresh
+		l.Warnf("unable to edit the status comment on PR-%d, adding a new one: %v", pr, err)
+	}
+	err = s.AddCommentToPr(owner, repo, pr, comment)
+	if err != nil {
+		l.Errorf("unable to update the status comment on PR-%d: %v", pr, err)
+	}
+}
+
+// statusLocks holds a mutex for each PR whose status comment is being updated, it is
+// removed once no update is waiting for it.
+type statusLocks struct {
+	mu    sync.Mutex
+	locks map[string]*statusLock
+}
+
+type statusLock struct {
+	sync.Mutex
+	// waiters counts the updates holding or waiting for the lock.
+	waiters int
+}
+
+// lock locks the status of the PR with the key, returning the func that unlocks it.
+func (s *statusLocks) lock(key string) func() {
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = map[string]*statusLock{}
+	}
+	lock, ok := s.locks[key]
+	if !ok {
+		lock = &statusLock{}
+		s.locks[key] = lock
+	}
+	lock.waiters++
+	s.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(s.locks, key)
+		}
+	}
+}
@@ -2,11 +2,16 @@ package webhook
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/garethjevans/backport/pkg/queue"
 	"github.com/garethjevans/backport/pkg/service"
 
 	"github.com/jenkins-x/go-scm/scm"
@@ -14,8 +19,48 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// defaultParallelism is the number of branches backported at the same time when the
+// controller's Parallelism is not set.
+const defaultParallelism = 2
+
 // Controller holds the command line arguments.
-type Controller struct{}
+type Controller struct {
+	// ScmFactory creates the Scm used to talk to the given server, when nil the
+	// credentials are looked up from kubernetes.
+	ScmFactory func(server service.Server) (service.Scm, error)
+
+	// GitHubApp, when set, authenticates with github as the app installation that
+	// sent the webhook rather than with the credentials from kubernetes.
+	GitHubApp *service.GitHubApp
+
+	// Options configures how backports are applied.
+	Options service.BackportOptions
+
+	// Authorization decides who can request backports with a comment.
+	Authorization service.Authorization
+
+	// Queue, when set, runs the backports in the background so that webhooks are
+	// acknowledged straight away, otherwise they are run before responding.
+	Queue *queue.Queue
+
+	// Parallelism is the number of branches that are backported at the same time
+	// when there is no queue, defaults to 2.
+	Parallelism int
+
+	// inflight tracks the backports currently being applied so that a label
+	// event racing a comment does not backport the same branch twice.
+	inflight sync.Map
+
+	// deliveries records the webhooks that have been handled, so that a webhook that
+	// is redelivered is acknowledged without being processed again.
+	deliveries deliveries
+
+	// statusLocks serialises the updates to the status comment of each PR.
+	statusLocks statusLocks
+
+	// configs caches the configuration of each repository.
+	configs configs
+}
 
 // Health returns either HTTP 204 if the service is healthy, otherwise nothing ('cos it's dead).
 func (o *Controller) Health(w http.ResponseWriter, _ *http.Request) {
@@ -38,8 +83,10 @@ func (o *Controller) DefaultHandler(w http.ResponseWriter, r *http.Request) {
 	o.HandleWebhookRequests(w, r)
 }
 
+// isReady reports whether the jobs that were unfinished when the service last
+// stopped have been resumed.
 func (o *Controller) isReady() bool {
-	return true
+	return o.Queue == nil || o.Queue.Ready()
 }
 
 // HandleWebhookRequests handles incoming webhook events.
@@ -75,7 +122,15 @@ func (o *Controller) handleWebhookOrPollRequest(w http.ResponseWriter, r *http.R
 
 	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-	scmClient := github.NewDefault()
+	server := ServerForRequest(r, bodyBytes)
+	normalizeHeaders(r.Header)
+
+	scmClient, err := o.webhookClient(server)
+	if err != nil {
+		logrus.Errorf("failed to create %s client: %s", server.Driver, err.Error())
+		responseHTTPError(w, http.StatusInternalServerError, fmt.Sprintf("500 Internal Server Error: %s", err.Error()))
+		return
+	}
 
 	webhook, err := parseWebhook(scmClient, r)
 	if err != nil {
@@ -91,9 +146,31 @@ func (o *Controller) handleWebhookOrPollRequest(w http.ResponseWriter, r *http.R
 
 	entry := logrus.WithField(operation, webhook.Kind())
 
-	l, output, err := o.ProcessWebHook(entry, webhook)
+	delivery := deliveryID(r.Header)
+	if delivery != "" {
+		entry = entry.WithField("Delivery", delivery)
+		if !o.deliveries.record(server.Driver+"/"+delivery, time.Now()) {
+			entry.Infof("ignoring duplicate delivery %s", delivery)
+			_, err = w.Write([]byte(fmt.Sprintf("ignored duplicate delivery %s", delivery)))
+			if err != nil {
+				entry.Debugf("failed to write the response: %v", err)
+			}
+			return
+		}
+	}
+
+	l, output, accepted, err := o.processWebHook(entry, server, webhook)
 	if err != nil {
+		// the delivery is processed again when it is redelivered
+		if delivery != "" {
+			o.deliveries.forget(server.Driver + "/" + delivery)
+		}
 		responseHTTPError(w, http.StatusInternalServerError, fmt.Sprintf("500 Internal Server Error: %s", err.Error()))
+		return
+	}
+
+	if accepted {
+		w.WriteHeader(http.StatusAccepted)
 	}
 
 	_, err = w.Write([]byte(output))
@@ -102,13 +179,29 @@ func (o *Controller) handleWebhookOrPollRequest(w http.ResponseWriter, r *http.R
 	}
 }
 
-// ProcessWebHook process a webhook.
-func (o *Controller) ProcessWebHook(l *logrus.Entry, webhook scm.Webhook) (*logrus.Entry, string, error) {
+// ProcessWebHook process a webhook sent by server.
+func (o *Controller) ProcessWebHook(l *logrus.Entry, server service.Server, webhook scm.Webhook) (*logrus.Entry, string, error) {
+	l, output, _, err := o.processWebHook(l, server, webhook)
+	return l, output, err
+}
+
+// processWebHook processes the webhook, reporting whether any backports were queued.
+// An error is returned if the webhook could not be handled, so that it can be
+// redelivered.
+func (o *Controller) processWebHook(l *logrus.Entry, server service.Server, webhook scm.Webhook) (*logrus.Entry, string, bool, error) {
+	if installation := webhook.GetInstallationRef(); installation != nil {
+		server.Installation = installation.ID
+	}
+
 	repository := webhook.Repository()
 	fields := map[string]interface{}{
-		"Repo": fmt.Sprintf("%s/%s", repository.Namespace, repository.Name),
-		"Link": repository.Link,
-		"Kind": webhook.Kind(),
+		"Repo":   fmt.Sprintf("%s/%s", repository.Namespace, repository.Name),
+		"Link":   repository.Link,
+		"Kind":   webhook.Kind(),
+		"Driver": server.Driver,
+	}
+	if server.Installation != 0 {
+		fields["Installation"] = server.Installation
 	}
 
 	l = l.WithFields(fields)
@@ -132,6 +225,8 @@ func (o *Controller) ProcessWebHook(l *logrus.Entry, webhook scm.Webhook) (*logr
 		fallthrough
 	case scm.WebhookKindIssue:
 		fallthrough
+	// label hooks describe changes to the repository's labels, a label added to
+	// a PR arrives as a pull request hook with a labeled action.
 	case scm.WebhookKindLabel:
 		fallthrough
 	case scm.WebhookKindPing:
@@ -153,7 +248,7 @@ func (o *Controller) ProcessWebHook(l *logrus.Entry, webhook scm.Webhook) (*logr
 	case scm.WebhookKindTag:
 		fallthrough
 	case scm.WebhookKindWatch:
-		return l, fmt.Sprintf("ignored webhook %s", webhook.Kind()), nil
+		return l, fmt.Sprintf("ignored webhook %s", webhook.Kind()), false, nil
 	case scm.WebhookKindPullRequest:
 		prHook, ok := webhook.(*scm.PullRequestHook)
 		if ok {
@@ -165,11 +260,12 @@ func (o *Controller) ProcessWebHook(l *logrus.Entry, webhook scm.Webhook) (*logr
 			fields["PR.Sha"] = pr.Sha
 			fields["PR.Title"] = pr.Title
 			fields["PR.Body"] = pr.Body
+			fields["Label.Name"] = prHook.Label.Name
 
 			l.Info("invoking PR handler")
 
-			o.handlePullRequestEvent(l, prHook)
-			return l, "processed PR hook", nil
+			accepted, err := o.handlePullRequestEvent(l, server, prHook)
+			return l, "processed PR hook", accepted, err
 		}
 	case scm.WebhookKindPullRequestComment:
 		prCommentHook, ok := webhook.(*scm.PullRequestCommentHook)
@@ -191,8 +287,8 @@ func (o *Controller) ProcessWebHook(l *logrus.Entry, webhook scm.Webhook) (*logr
 
 			l.Info("invoking PR Comment handler")
 
-			o.handlePullRequestCommentEvent(l, *prCommentHook)
-			return l, "processed PR comment hook", nil
+			accepted, err := o.handlePullRequestCommentEvent(l, server, *prCommentHook)
+			return l, "processed PR comment hook", accepted, err
 		}
 
 	case scm.WebhookKindIssueComment:
@@ -213,195 +309,555 @@ func (o *Controller) ProcessWebHook(l *logrus.Entry, webhook scm.Webhook) (*logr
 
 			l.Info("invoking Issue Comment handler")
 
-			o.handleIssueCommentEvent(l, *issueCommentHook)
-			return l, "processed issue comment hook", nil
+			accepted, err := o.handleIssueCommentEvent(l, server, *issueCommentHook)
+			return l, "processed issue comment hook", accepted, err
 		}
 	}
 
 	l.Debugf("unknown kind %s webhook %#v", webhook.Kind(), webhook)
-	return l, fmt.Sprintf("unknown hook %s", webhook.Kind()), nil
+	return l, fmt.Sprintf("unknown hook %s", webhook.Kind()), false, nil
 }
 
 func (o *Controller) secretFn(scm.Webhook) (string, error) {
 	return HMACToken(), nil
 }
 
-func (o *Controller) handlePullRequestCommentEvent(l *logrus.Entry, hook scm.PullRequestCommentHook) {
+// webhookClient returns the client used to parse webhooks sent by server, gitlab and
+// gitea look up the comment author or PR while parsing so need an authenticated client.
+func (o *Controller) webhookClient(server service.Server) (*scm.Client, error) {
+	if server.Driver == service.DriverGitHub {
+		return github.NewDefault(), nil
+	}
+
+	k := service.NewKubernetes()
+	_, t, err := k.GetCredentials(server.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.NewClient(server, t)
+}
+
+func (o *Controller) handlePullRequestCommentEvent(l *logrus.Entry, server service.Server, hook scm.PullRequestCommentHook) (bool, error) {
 	l.Infof("handling comment on PR-%d", hook.PullRequest.Number)
 	l.Infof("new comment '%s'", hook.Comment.Body)
 
 	body := hook.Comment.Body
 
-	parts := strings.Split(hook.Repo.FullName, "/")
-	err := o.HandleComment(l, "https://github.com", parts[0], parts[1], body, hook.PullRequest.Number)
+	accepted, err := o.handleComment(l, server, hook.Repo.Namespace, hook.Repo.Name, hook.Comment.Author.Login, body, hook.PullRequest.Number)
 	if err != nil {
 		logrus.Errorf("Unable to handle PR comment: %v", err)
 	}
+	return accepted, err
 }
 
-func (o *Controller) handleIssueCommentEvent(l *logrus.Entry, hook scm.IssueCommentHook) {
+func (o *Controller) handleIssueCommentEvent(l *logrus.Entry, server service.Server, hook scm.IssueCommentHook) (bool, error) {
 	l.Infof("handling comment on Issue %d", hook.Issue.Number)
 	l.Infof("new comment '%s'", hook.Comment.Body)
 
 	body := hook.Comment.Body
 
-	parts := strings.Split(hook.Repo.FullName, "/")
-	err := o.HandleComment(l, "https://github.com", parts[0], parts[1], body, hook.Issue.Number)
+	accepted, err := o.handleComment(l, server, hook.Repo.Namespace, hook.Repo.Name, hook.Comment.Author.Login, body, hook.Issue.Number)
 	if err != nil {
 		logrus.Errorf("Unable to handle issue comment: %v", err)
 	}
+	return accepted, err
+}
+
+// HandleComment adds a label for each branch requested by the comment, if the PR has
+// already been merged the newly requested branches are backported straight away. A
+// comment by a user who cannot request backports is answered with a refusal.
+func (o *Controller) HandleComment(l *logrus.Entry, server service.Server, owner string, repo string, author string, body string, pr int) error {
+	_, err := o.handleComment(l, server, owner, repo, author, body, pr)
+	return err
 }
 
-func (o *Controller) HandleComment(l *logrus.Entry, host string, owner string, repo string, body string, pr int) error {
-	labels, messages, err := DetermineLabelsToAddFromComment(body, newLabelLister(host, owner, repo))
+// handleComment handles the comment, reporting whether any backports were queued.
+func (o *Controller) handleComment(l *logrus.Entry, server service.Server, owner string, repo string, author string, body string, pr int) (bool, error) {
+	if !requestsBackport(body) {
+		return false, nil
+	}
+
+	s, err := o.scm(l, server)
+	if err != nil {
+		return false, err
+	}
+
+	config, opts, err := o.repoOptions(l, server, s, owner, repo)
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		// the repository's own authorization cannot be read, so whether the commenter
+		// may hear about its configuration is decided by the service's
+		ok, err := authorized(l, s, owner, repo, author, o.Authorization)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, s.AddCommentToPr(owner, repo, pr, refusal(author, o.Authorization))
+		}
+		return false, s.AddCommentToPr(owner, repo, pr, fmt.Sprintf("Unable to backport, %s", configErr.Error()))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	a := config.Authorization(o.Authorization)
+	ok, err := authorized(l, s, owner, repo, author, a)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, s.AddCommentToPr(owner, repo, pr, refusal(author, a))
+	}
+
+	err = o.cancelBackports(l, server, s, owner, repo, pr, body, config, opts)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	for _, label := range labels {
-		err := o.addLabelToPr(l, host, owner, repo, pr, label)
+	retried, err := o.retryBackports(l, server, s, owner, repo, pr, body, config, opts)
+	if err != nil {
+		return retried, err
+	}
+
+	err = o.reportStatus(l, server, s, owner, repo, pr, body, config, opts)
+	if err != nil {
+		return retried, err
+	}
+
+	labels, messages, err := DetermineLabelsToAddFromComment(body, newLabelLister(s, owner, repo), config)
+	if err != nil {
+		return retried, err
+	}
+
+	var branches []string
+	if len(labels) > 0 {
+		existing, err := s.DetermineBranchesForPr(owner, repo, pr, config.Prefix())
 		if err != nil {
-			return err
+			return retried, err
+		}
+
+		for _, label := range labels {
+			branch := strings.TrimPrefix(label, config.Prefix())
+			if !contains(existing, branch) {
+				branches = append(branches, branch)
+			}
+		}
+	}
+
+	for _, branch := range branches {
+		err := s.AddBackportBranchToPr(owner, repo, pr, branch, config.Prefix())
+		if err != nil {
+			return retried, err
 		}
 	}
 
 	for _, message := range messages {
-		err := o.addCommentToPr(l, host, owner, repo, pr, message)
+		err := s.AddCommentToPr(owner, repo, pr, message)
 		if err != nil {
-			return err
+			return retried, err
 		}
 	}
 
-	return nil
+	if len(branches) == 0 {
+		return retried, nil
+	}
+
+	merged, err := s.IsPrMerged(owner, repo, pr)
+	if err != nil {
+		return retried, err
+	}
+
+	if !merged {
+		l.Debugf("PR-%d has not been merged, deferring backport to %s", pr, branches)
+		return retried, nil
+	}
+
+	accepted, err := o.backportBranches(l, server, s, owner, repo, pr, branches, config, opts)
+	return accepted || retried, err
 }
 
-func newLabelLister(host string, owner string, repo string) Lister {
-	return &labelLister{host: host, owner: owner, repo: repo}
+func newLabelLister(s service.Scm, owner string, repo string) Lister {
+	return &labelLister{scm: s, owner: owner, repo: repo}
 }
 
 type labelLister struct {
-	host  string
+	scm   service.Scm
 	owner string
 	repo  string
 }
 
 func (l *labelLister) Branches() ([]string, error) {
-	k := service.NewKubernetes()
-	u, t, err := k.GetCredentials(l.host)
-	if err != nil {
-		return nil, err
+	return l.scm.ListBranchesForRepo(l.owner, l.repo)
+}
+
+func (o *Controller) scm(l *logrus.Entry, server service.Server) (service.Scm, error) {
+	if o.ScmFactory != nil {
+		return o.ScmFactory(server)
 	}
 
-	s := service.NewScm(l.host, u, t)
-	return s.ListBranchesForRepo(l.owner, l.repo)
-}
+	if o.GitHubApp != nil && server.Driver == service.DriverGitHub && server.Installation != 0 {
+		l.Debugf("authenticating as installation %d", server.Installation)
+		return service.NewGitHubAppScm(server, o.GitHubApp)
+	}
 
-func (o *Controller) applyBackports(l *logrus.Entry, host string, owner string, repo string, pr int) error {
 	k := service.NewKubernetes()
-	u, t, err := k.GetCredentials(host)
+	u, t, err := k.GetCredentials(server.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	l.Debugf("username=%s, password=XXX", u)
 
-	s := service.NewScm(host, u, t)
-	commits, err := s.ListCommitsForPr(owner, repo, pr)
+	return service.NewScm(server, u, t), nil
+}
+
+func (o *Controller) applyBackports(l *logrus.Entry, server service.Server, owner string, repo string, pr int) (bool, error) {
+	s, err := o.scm(l, server)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	l.Infof("commits=%s", commits)
+	config, opts, err := o.repoOptions(l, server, s, owner, repo)
+	if err != nil {
+		return false, err
+	}
 
-	branches, err := s.DetermineBranchesForPr(owner, repo, pr)
+	requested, err := s.DetermineBranchesForPr(owner, repo, pr, config.Prefix())
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	var branches []string
+	for _, branch := range requested {
+		if !config.AllowsBranch(branch) {
+			l.Infof("backporting to %s is not allowed by %s", branch, service.ConfigPath)
+			continue
+		}
+		branches = append(branches, branch)
 	}
 
+	return o.backportBranches(l, server, s, owner, repo, pr, branches, config, opts)
+}
+
+// backportBranches queues a job to backport pr to each branch, or when there is no
+// queue backports them straight away, reporting whether any jobs were queued. The
+// branches are backported independently and the progress of each is kept in a
+// single status comment on the PR. A PR without the approvals the repository requires
+// is not backported.
+func (o *Controller) backportBranches(l *logrus.Entry, server service.Server, s service.Scm, owner string, repo string, pr int, branches []string, config *service.RepoConfig, opts service.BackportOptions) (bool, error) {
 	l.Infof("branches=%s", branches)
+	if len(branches) == 0 {
+		return false, nil
+	}
 
-	for _, branch := range branches {
-		err = s.ApplyCommitsToRepo(owner, repo, pr, branch, commits)
+	if config.RequiredApprovals > 0 {
+		approvals, err := s.CountApprovalsForPr(owner, repo, pr)
 		if err != nil {
-			return err
+			return false, err
+		}
+
+		if approvals < config.RequiredApprovals {
+			l.Infof("PR-%d has %d of the %d approvals required to backport it", pr, approvals, config.RequiredApprovals)
+			err := fmt.Errorf("PR-%d needs %d approvals to be backported, it has %d", pr, config.RequiredApprovals, approvals)
+			var statuses []branchStatus
+			for _, branch := range branches {
+				statuses = append(statuses, finished(branch, service.BackportResult{}, err))
+			}
+			o.setStatus(l, s, owner, repo, pr, statuses...)
+			return false, nil
 		}
 	}
 
-	return nil
-}
+	if o.Queue != nil {
+		jobs, enqueued := o.Queue.EnqueueAll(server, owner, repo, pr, branches)
+		var waiting []string
+		for i, job := range jobs {
+			if enqueued[i] {
+				l.Infof("queued backport of PR-%d to %s as job %d", pr, job.Branch, job.ID)
+				waiting = append(waiting, job.Branch)
+			} else {
+				l.Infof("backport of PR-%d to %s is already %s as job %d", pr, job.Branch, job.Status, job.ID)
+			}
+		}
+		if len(waiting) > 0 {
+			o.setStatus(l, s, owner, repo, pr, queued(waiting)...)
+		}
+		return true, nil
+	}
 
-func (o *Controller) handlePullRequestEvent(l *logrus.Entry, hook *scm.PullRequestHook) {
-	l.Infof("handling pull request event %d", hook.PullRequest.Number)
+	o.setStatus(l, s, owner, repo, pr, queued(branches)...)
 
-	// need to filter on these, we are currently getting to many.
-	// only do it on merge?
-	if hook.Action.String() == "closed" && hook.PullRequest.Merged {
-		parts := strings.Split(hook.Repo.FullName, "/")
+	commits, err := s.ListCommitsForPr(owner, repo, pr)
+	if err != nil {
+		var statuses []branchStatus
+		for _, branch := range branches {
+			statuses = append(statuses, finished(branch, service.BackportResult{}, err))
+		}
+		o.setStatus(l, s, owner, repo, pr, statuses...)
+		return false, err
+	}
+
+	l.Infof("commits=%s", commits)
+
+	parallelism := o.Parallelism
+	if parallelism < 1 {
+		parallelism = defaultParallelism
+	}
+
+	failures := make([]error, len(branches))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, branch := range branches {
+		wg.Add(1)
+		go func(i int, branch string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result, err := o.backportBranch(l, server, s, owner, repo, pr, branch, commits, opts)
+			if err != nil {
+				l.Errorf("unable to backport PR-%d to %s: %v", pr, branch, err)
+				failures[i] = err
+			}
+			if !result.InProgress {
+				o.setStatus(l, s, owner, repo, pr, finished(branch, result, err))
+			}
+		}(i, branch)
+	}
+	wg.Wait()
 
-		err := o.applyBackports(l, "https://github.com", parts[0], parts[1], hook.PullRequest.Number)
+	var failed []string
+	for i, err := range failures {
 		if err != nil {
-			logrus.Errorf("Unable to apply backports %v", err)
+			failed = append(failed, branches[i])
 		}
 	}
+	if len(failed) > 0 {
+		return false, fmt.Errorf("unable to backport PR-%d to %s", pr, strings.Join(failed, ", "))
+	}
+	return false, nil
 }
 
-func (o *Controller) addLabelToPr(l *logrus.Entry, host string, owner string, repo string, pr int, label string) error {
-	k := service.NewKubernetes()
-	u, t, err := k.GetCredentials(host)
+// RunJob backports the PR in the job to its branch, it is the handler of the
+// controller's queue.
+func (o *Controller) RunJob(job queue.Job) (service.BackportResult, error) {
+	l := logrus.WithFields(logrus.Fields{
+		"Repo":      fmt.Sprintf("%s/%s", job.Owner, job.Repo),
+		"PR.Number": job.PR,
+		"Branch":    job.Branch,
+		"Job":       job.ID,
+	})
+
+	s, err := o.scm(l, job.Server)
 	if err != nil {
-		return err
+		return service.BackportResult{}, err
 	}
 
-	l.Debugf("username=%s, password=XXX", u)
+	result, err := o.runJob(l, s, job)
+	if !result.InProgress {
+		o.setStatus(l, s, job.Owner, job.Repo, job.PR, finished(job.Branch, result, err))
+	}
+
+	// a conflict will not be resolved by trying again
+	var cherryPickErr *service.CherryPickError
+	if errors.As(err, &cherryPickErr) {
+		return result, queue.Permanent(err)
+	}
+
+	return result, err
+}
 
-	s := service.NewScm(host, u, t)
+// runJob backports the PR in the job to its branch.
+func (o *Controller) runJob(l *logrus.Entry, s service.Scm, job queue.Job) (service.BackportResult, error) {
+	_, opts, err := o.repoOptions(l, job.Server, s, job.Owner, job.Repo)
+	if err != nil {
+		return service.BackportResult{}, err
+	}
 
-	err = s.AddLabelToPr(owner, repo, pr, label)
+	commits, err := s.ListCommitsForPr(job.Owner, job.Repo, job.PR)
 	if err != nil {
-		return err
+		return service.BackportResult{}, err
 	}
 
-	return nil
+	l.Infof("commits=%s", commits)
+
+	return o.backportBranch(l, job.Server, s, job.Owner, job.Repo, job.PR, job.Branch, commits, opts)
 }
 
-func (o *Controller) addCommentToPr(l *logrus.Entry, host string, owner string, repo string, pr int, message string) error {
-	k := service.NewKubernetes()
-	u, t, err := k.GetCredentials(host)
+// backportBranch backports pr to branch unless it has already been backported. A
+// backport that is already being applied is left to finish, and reported as in
+// progress rather than failed.
+func (o *Controller) backportBranch(l *logrus.Entry, server service.Server, s service.Scm, owner string, repo string, pr int, branch string, commits []string, opts service.BackportOptions) (service.BackportResult, error) {
+	result := service.BackportResult{Branch: branch}
+
+	// the key matches the queue's, so that the same branch of a PR on another server
+	// is not mistaken for this one
+	job := queue.Job{Server: server, Owner: owner, Repo: repo, PR: pr, Branch: branch}
+	if _, loaded := o.inflight.LoadOrStore(job.Key(), true); loaded {
+		l.Infof("backport of PR-%d to %s is already in progress", pr, branch)
+		result.InProgress = true
+		return result, nil
+	}
+	defer o.inflight.Delete(job.Key())
+
+	o.setStatus(l, s, owner, repo, pr, branchStatus{Branch: branch, State: stateRunning})
+
+	existing, err := s.FindBackportPr(owner, repo, pr, branch, opts)
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	l.Debugf("username=%s, password=XXX", u)
+	if backported(existing) {
+		l.Infof("PR-%d has already been backported to %s in PR-%d", pr, branch, existing.Number)
+		result.Number, result.Link, result.Existing = existing.Number, existing.Link, true
+		return result, nil
+	}
 
-	s := service.NewScm(host, u, t)
+	return s.ApplyCommitsToRepo(owner, repo, pr, branch, commits, opts)
+}
 
-	err = s.AddCommentToPr(owner, repo, pr, message)
+// backported reports whether a backport PR is open or merged, a PR that was closed
+// without being merged does not count and the branch is backported again.
+func backported(backport *scm.PullRequest) bool {
+	return backport != nil && (backport.Merged || !backport.Closed)
+}
+
+func (o *Controller) handlePullRequestEvent(l *logrus.Entry, server service.Server, hook *scm.PullRequestHook) (bool, error) {
+	l.Infof("handling pull request event %d", hook.PullRequest.Number)
+
+	// need to filter on these, we are currently getting to many.
+	// only do it on merge? github closes a merged PR, gitlab sends a merge action.
+	if (hook.Action == scm.ActionClose || hook.Action == scm.ActionMerge) && hook.PullRequest.Merged {
+		accepted, err := o.applyBackports(l, server, hook.Repo.Namespace, hook.Repo.Name, hook.PullRequest.Number)
+		if err != nil {
+			logrus.Errorf("Unable to apply backports %v", err)
+		}
+		return accepted, err
+	}
+
+	// a backport label added by hand after the merge only needs that branch backporting.
+	if hook.Action == scm.ActionLabel && hook.PullRequest.Merged {
+		accepted, err := o.applyBackport(l, server, hook.Repo.Namespace, hook.Repo.Name, hook.PullRequest.Number, hook.Label.Name, hook.Sender.Login)
+		if err != nil {
+			logrus.Errorf("Unable to apply backport for label %s %v", hook.Label.Name, err)
+		}
+		return accepted, err
+	}
+
+	return false, nil
+}
+
+// applyBackport backports the PR to the branch requested by label, if it is a
+// backport label that was not added by the bot itself.
+func (o *Controller) applyBackport(l *logrus.Entry, server service.Server, owner string, repo string, pr int, label string, sender string) (bool, error) {
+	s, err := o.scm(l, server)
+	if err != nil {
+		return false, err
+	}
+
+	config, opts, err := o.repoOptions(l, server, s, owner, repo)
+	if err != nil {
+		return false, err
+	}
+
+	if !strings.HasPrefix(label, config.Prefix()) {
+		return false, nil
+	}
+
+	branch := strings.TrimPrefix(label, config.Prefix())
+	if !config.AllowsBranch(branch) {
+		l.Infof("backporting to %s is not allowed by %s", branch, service.ConfigPath)
+		return false, nil
+	}
+
+	// the bot labels the branches requested by a comment, which it backports itself
+	login, err := s.AuthenticatedLogin()
 	if err != nil {
-		return err
+		return false, err
 	}
+	if strings.EqualFold(sender, login) {
+		l.Infof("ignoring the label %s added by %s", label, sender)
+		return false, nil
+	}
+
+	return o.backportBranches(l, server, s, owner, repo, pr, []string{branch}, config, opts)
+}
 
-	return nil
+// requestsBackport reports whether the comment has any /backport commands, including
+// those that cannot be parsed.
+func requestsBackport(body string) bool {
+	commands, messages := parseCommands(body)
+	return len(commands) > 0 || len(messages) > 0
 }
 
-func DetermineLabelsToAddFromComment(body string, lister Lister) ([]string, []string, error) {
-	var messages []string
+// DetermineLabelsToAddFromComment returns the labels for the branches requested by the
+// /backport commands in the comment, along with a message for each command or branch
+// that cannot be backported. A command can name several branches, separated by spaces
+// or commas, patterns that match the existing branches, and all-supported for every
+// branch the repository's configuration allows.
+func DetermineLabelsToAddFromComment(body string, lister Lister, config *service.RepoConfig) ([]string, []string, error) {
 	var labels []string
 
+	commands, messages := parseCommands(body)
+	commands = commandsWithAction(commands, actionBackport)
+	if len(commands) == 0 {
+		return labels, messages, nil
+	}
+
 	existingBranches, err := lister.Branches()
 	if err != nil {
 		return labels, messages, err
 	}
 
-	commentLines := strings.Split(body, "\n")
-	for _, line := range commentLines {
-		if strings.HasPrefix(line, "/backport") {
-			branch := strings.TrimPrefix(line, "/backport ")
-			branch = strings.TrimSpace(branch)
+	add := func(branch string) {
+		label := fmt.Sprintf("%s%s", config.Prefix(), branch)
+		if !contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
 
-			if contains(existingBranches, branch) {
-				labels = append(labels, fmt.Sprintf("%s%s", service.LabelPrefix, branch))
-			} else {
-				messages = append(messages, fmt.Sprintf("Unable to locate branch %s", branch))
+	for _, c := range commands {
+		for _, arg := range c.args {
+			switch {
+			case arg == allSupported:
+				if len(config.Branches) == 0 {
+					messages = append(messages, fmt.Sprintf("Unable to backport to %s, %s does not list the supported branches", allSupported, service.ConfigPath))
+					continue
+				}
+				for _, branch := range existingBranches {
+					if config.AllowsBranch(branch) {
+						add(branch)
+					}
+				}
+
+			case isPattern(arg):
+				var matched, allowed []string
+				for _, branch := range existingBranches {
+					if ok, _ := path.Match(arg, branch); ok {
+						matched = append(matched, branch)
+						if config.AllowsBranch(branch) {
+							allowed = append(allowed, branch)
+						}
+					}
+				}
+				if len(matched) == 0 {
+					messages = append(messages, fmt.Sprintf("Unable to locate any branches matching %s", arg))
+				} else if len(allowed) == 0 {
+					messages = append(messages, fmt.Sprintf("Backporting to %s is not allowed by %s", strings.Join(matched, ", "), service.ConfigPath))
+				}
+				for _, branch := range allowed {
+					add(branch)
+				}
+
+			case !contains(existingBranches, arg):
+				messages = append(messages, fmt.Sprintf("Unable to locate branch %s", arg))
+
+			case !config.AllowsBranch(arg):
+				messages = append(messages, fmt.Sprintf("Backporting to %s is not allowed by %s", arg, service.ConfigPath))
+
+			default:
+				add(arg)
 			}
 		}
 	}
@@ -2,10 +2,12 @@ package webhook_test
 
 import (
 	"bytes"
+	"errors"
 	"net/http"
 	"os"
 	"testing"
 
+	"github.com/garethjevans/backport/pkg/service"
 	"github.com/garethjevans/backport/pkg/webhook"
 	http2 "github.com/stretchr/testify/http"
 
@@ -31,7 +33,7 @@ func (suite *WebhookTestSuite) TestProcessWebhookPRComment() {
 	}
 
 	l := logrus.WithField("test", t.Name())
-	entry, message, err := suite.Controller.ProcessWebHook(l, w)
+	entry, message, err := suite.Controller.ProcessWebHook(l, githubServer, w)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "processed PR comment hook", message)
@@ -47,7 +49,7 @@ func (suite *WebhookTestSuite) TestProcessWebhookPR() {
 	}
 
 	l := logrus.WithField("test", t.Name())
-	entry, message, err := suite.Controller.ProcessWebHook(l, w)
+	entry, message, err := suite.Controller.ProcessWebHook(l, githubServer, w)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "processed PR hook", message)
@@ -70,7 +72,7 @@ func (suite *WebhookTestSuite) TestProcessWebhookPRReview() {
 	}
 
 	l := logrus.WithField("test", t.Name())
-	entry, message, err := suite.Controller.ProcessWebHook(l, w)
+	entry, message, err := suite.Controller.ProcessWebHook(l, githubServer, w)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "ignored webhook review", message)
@@ -96,6 +98,66 @@ func (suite *WebhookTestSuite) TestParseWebHook() {
 	assert.Equal(t, http.StatusOK, w.StatusCode)
 }
 
+func (suite *WebhookTestSuite) TestRedeliveredWebHook() {
+	t := suite.T()
+
+	pingBytes, err := os.ReadFile("testdata/ping.json")
+	assert.NoError(t, err)
+
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		w := &http2.TestResponseWriter{}
+
+		r, err := http.NewRequest("POST", "/", bytes.NewReader(pingBytes))
+		assert.NoError(t, err)
+
+		r.Header.Add("X-GitHub-Delivery", "5b3c7a9e-c262-11ed-90c1-3124ac07309e")
+		r.Header.Add("X-GitHub-Event", "push")
+
+		suite.Controller.DefaultHandler(w, r)
+
+		assert.Equal(t, http.StatusOK, w.StatusCode)
+		outputs = append(outputs, w.Output)
+	}
+
+	assert.Equal(t, "ignored webhook push", outputs[0])
+	assert.Equal(t, "ignored duplicate delivery 5b3c7a9e-c262-11ed-90c1-3124ac07309e", outputs[1])
+}
+
+func TestRedeliveredFailedWebHook(t *testing.T) {
+	payload, err := os.ReadFile("testdata/pull_request_merged.json")
+	assert.NoError(t, err)
+
+	calls := 0
+	c := &webhook.Controller{
+		ScmFactory: func(server service.Server) (service.Scm, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("unable to reach github")
+			}
+			return &fakeScm{}, nil
+		},
+	}
+
+	var statuses []int
+	for i := 0; i < 2; i++ {
+		w := &http2.TestResponseWriter{}
+
+		r, err := http.NewRequest("POST", "/", bytes.NewReader(payload))
+		assert.NoError(t, err)
+
+		r.Header.Add("X-GitHub-Delivery", "8d1c2f4e-c262-11ed-90c1-3124ac07309e")
+		r.Header.Add("X-GitHub-Event", "pull_request")
+
+		c.DefaultHandler(w, r)
+		statuses = append(statuses, w.StatusCode)
+	}
+
+	// the delivery that failed is processed again when it is redelivered
+	assert.Equal(t, []int{http.StatusInternalServerError, http.StatusOK}, statuses)
+	assert.Equal(t, 2, calls)
+}
+
 func (suite *WebhookTestSuite) SetupSuite() {
 	suite.Controller = &webhook.Controller{}
 	suite.TestRepo = scm.Repository{
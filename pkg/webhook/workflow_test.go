@@ -3,6 +3,7 @@ package webhook_test
 import (
 	"testing"
 
+	"github.com/garethjevans/backport/pkg/service"
 	"github.com/garethjevans/backport/pkg/webhook"
 
 	"github.com/stretchr/testify/assert"
@@ -11,6 +12,7 @@ import (
 func TestWorkflow(t *testing.T) {
 	type test struct {
 		body             string
+		config           service.RepoConfig
 		existingBranches []string
 		expectedLabels   []string
 		expectedMessages []string
@@ -38,13 +40,72 @@ func TestWorkflow(t *testing.T) {
 			expectedLabels:   []string{"Backport to 1.1.x"},
 			expectedMessages: []string{"Unable to locate branch 1.2.x"},
 		},
+		{
+			body:             "/backport 1.1.x\n/backport main",
+			config:           service.RepoConfig{Branches: []string{"1.*"}},
+			existingBranches: []string{"main", "1.1.x"},
+			expectedLabels:   []string{"Backport to 1.1.x"},
+			expectedMessages: []string{"Backporting to main is not allowed by .github/backport.yml"},
+		},
+		{
+			body:             "/backport 1.1.x",
+			config:           service.RepoConfig{LabelPrefix: "backport/"},
+			existingBranches: []string{"1.1.x"},
+			expectedLabels:   []string{"backport/1.1.x"},
+		},
+		{
+			body:             "/backport 1.1.x 1.2.x",
+			existingBranches: []string{"1.1.x", "1.2.x"},
+			expectedLabels:   []string{"Backport to 1.1.x", "Backport to 1.2.x"},
+		},
+		{
+			body:             "/backport 1.1.x, 1.2.x,1.3.x\r\n",
+			existingBranches: []string{"1.1.x", "1.2.x", "1.3.x"},
+			expectedLabels:   []string{"Backport to 1.1.x", "Backport to 1.2.x", "Backport to 1.3.x"},
+		},
+		{
+			body:             "/backport release-1.* 1.1.x",
+			existingBranches: []string{"main", "1.1.x", "release-1.0", "release-1.1", "release-2.0"},
+			expectedLabels:   []string{"Backport to release-1.0", "Backport to release-1.1", "Backport to 1.1.x"},
+		},
+		{
+			body:             "/backport release-3.*",
+			existingBranches: []string{"release-1.0"},
+			expectedMessages: []string{"Unable to locate any branches matching release-3.*"},
+		},
+		{
+			body:             "/backport release-[",
+			existingBranches: []string{"release-1.0"},
+			expectedMessages: []string{"Unable to parse `/backport release-[`, `release-[` is not a valid branch pattern"},
+		},
+		{
+			body:             "/backport all-supported\n/backport 1.1.x",
+			config:           service.RepoConfig{Branches: []string{"1.*", "release-*"}},
+			existingBranches: []string{"main", "1.1.x", "1.2.x", "release-1.0"},
+			expectedLabels:   []string{"Backport to 1.1.x", "Backport to 1.2.x", "Backport to release-1.0"},
+		},
+		{
+			body:             "/backport all-supported",
+			existingBranches: []string{"main", "1.1.x"},
+			expectedMessages: []string{"Unable to backport to all-supported, .github/backport.yml does not list the supported branches"},
+		},
+		{
+			body:             "/backport",
+			existingBranches: []string{"1.1.x"},
+			expectedMessages: []string{"Unable to parse `/backport`, expected the branches to backport to, e.g. `/backport 1.x 2.x`"},
+		},
+		{
+			body:             "> /backport 1.1.x\n\nsee `/backport 1.2.x`\n```\n/backport 1.3.x\n```\n~~~~\n```\n/backport 1.3.x\n~~~~\n    /backport 1.3.x\n /backport 1.4.x\n/backports 1.3.x",
+			existingBranches: []string{"1.1.x", "1.2.x", "1.3.x", "1.4.x"},
+			expectedLabels:   []string{"Backport to 1.4.x"},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.body, func(t *testing.T) {
 			labels, messages, err := webhook.DetermineLabelsToAddFromComment(test.body, &fakeLister{
 				branches: test.existingBranches,
-			})
+			}, &test.config)
 
 			assert.NoError(t, err)
 			assert.Equal(t, test.expectedLabels, labels)